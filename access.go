@@ -143,5 +143,6 @@ func fileAccessHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		setAccessKeyCookies(w, getSiteURL(r), fileName, metadata.AccessKey, expiry)
 	}
 
+	slideExpiry(fileName, metadata)
 	fileDisplayHandler(c, w, r, fileName, metadata)
 }
@@ -0,0 +1,73 @@
+// Package backendurl describes storage backends with URLs, for options
+// that take more than one backend:
+//
+//	localfs:///srv/linx/files?meta=/srv/linx/meta&blobs=/srv/linx/blobs&shard-depth=2
+//	s3://mybucket?region=us-east-1&endpoint=https://s3.example.org&force-path-style=true
+//	memory://?max-size=1073741824
+//
+// Relative localfs paths are written without the slashes, as in
+// localfs:files?meta=meta.
+package backendurl
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/backends/s3"
+)
+
+var errMissingPath = errors.New("backendurl: localfs needs a files path and a meta parameter")
+var errMissingBucket = errors.New("backendurl: s3 needs a bucket")
+
+// Open returns the backend described by rawurl.
+func Open(rawurl string) (backends.MetaStorageBackend, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+
+	switch u.Scheme {
+	case "localfs":
+		filesPath := u.Path
+		if u.Opaque != "" {
+			filesPath = u.Opaque
+		}
+		if filesPath == "" || q.Get("meta") == "" {
+			return nil, errMissingPath
+		}
+
+		o := localfs.LocalfsOptions{BlobsPath: q.Get("blobs")}
+		if depth := q.Get("shard-depth"); depth != "" {
+			o.ShardDepth, err = strconv.Atoi(depth)
+			if err != nil || o.ShardDepth < 0 || o.ShardDepth > localfs.MaxShardDepth {
+				return nil, fmt.Errorf("backendurl: invalid shard-depth %q", depth)
+			}
+		}
+		return localfs.NewLocalfsBackendWithOptions(q.Get("meta"), filesPath, o), nil
+
+	case "s3":
+		if u.Host == "" {
+			return nil, errMissingBucket
+		}
+		forcePathStyle, _ := strconv.ParseBool(q.Get("force-path-style"))
+		return s3.NewS3Backend(u.Host, q.Get("region"), q.Get("endpoint"), forcePathStyle), nil
+
+	case "memory":
+		var maxSize int64
+		if size := q.Get("max-size"); size != "" {
+			maxSize, err = strconv.ParseInt(size, 10, 64)
+			if err != nil || maxSize < 0 {
+				return nil, fmt.Errorf("backendurl: invalid max-size %q", size)
+			}
+		}
+		return memory.NewMemoryBackend(maxSize), nil
+	}
+
+	return nil, fmt.Errorf("backendurl: unknown backend %q", u.Scheme)
+}
@@ -0,0 +1,51 @@
+package backendurl
+
+import (
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/backends/s3"
+)
+
+func TestOpen(t *testing.T) {
+	b, err := Open("localfs:///srv/files?meta=/srv/meta&shard-depth=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.(localfs.LocalfsBackend); !ok {
+		t.Fatalf("Expected a localfs backend, got %T", b)
+	}
+
+	if _, err = Open("localfs:files?meta=meta"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = Open("s3://linx?region=us-east-1&force-path-style=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.(s3.S3Backend); !ok {
+		t.Fatalf("Expected an S3 backend, got %T", b)
+	}
+
+	b, err = Open("memory://?max-size=1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.(*memory.MemoryBackend); !ok {
+		t.Fatalf("Expected a memory backend, got %T", b)
+	}
+
+	for _, bad := range []string{
+		"localfs:///srv/files",
+		"localfs:///srv/files?meta=/srv/meta&shard-depth=9",
+		"s3://?region=us-east-1",
+		"memory://?max-size=lots",
+		"ftp://example.org",
+	} {
+		if _, err = Open(bad); err == nil {
+			t.Fatalf("Opening %s did not fail", bad)
+		}
+	}
+}
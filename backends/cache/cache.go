@@ -0,0 +1,399 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/minio/sha256-simd"
+)
+
+// Metadata of this many files at most is kept, whether their contents are
+// cached or not.
+const maxEntries = 100000
+
+const tempPrefix = ".tmp-"
+
+type entry struct {
+	key      string
+	metadata backends.Metadata
+	size     int64     // of the cached contents, or -1 if only metadata is cached
+	modtime  time.Time // of the contents in the inner backend, if known
+}
+
+// modTimer is implemented by backends that know when a file was last
+// written, which is passed on with cached contents so that conditional
+// requests keep working.
+type modTimer interface {
+	ModTime(key string) (time.Time, error)
+}
+
+// Stats counts how often lookups were answered from the cache.
+type Stats struct {
+	Hits           int64
+	Misses         int64
+	MetadataHits   int64
+	MetadataMisses int64
+	Used           int64 // bytes of cached contents
+}
+
+// CachedBackend keeps the contents of recently used files in a directory
+// on local disk, and their metadata in memory, in front of a slower
+// backend such as S3. Cached contents are limited to maxSize bytes, least
+// recently used files are evicted first. Files are dropped from the cache
+// when they are changed or deleted through it, while changes to their
+// metadata alone are applied to the cache.
+type CachedBackend struct {
+	inner   backends.MetaStorageBackend
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	items   map[string]*list.Element
+	lru     *list.List // most recently used at the front
+	used    int64
+	filling map[string]chan struct{}
+	readers map[string]int    // reads of a file from inner in progress
+	gens    map[string]uint64 // incremented when a file being read changes
+	stats   Stats
+}
+
+// NewCachedBackend returns a CachedBackend storing contents in dir. The
+// cache starts out empty, files left in dir by a previous run are removed.
+func NewCachedBackend(inner backends.MetaStorageBackend, dir string, maxSize int64) (*CachedBackend, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if isCacheFile(info.Name()) {
+			os.Remove(filepath.Join(dir, info.Name()))
+		}
+	}
+
+	return &CachedBackend{
+		inner:   inner,
+		dir:     dir,
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+		filling: make(map[string]chan struct{}),
+		readers: make(map[string]int),
+		gens:    make(map[string]uint64),
+	}, nil
+}
+
+func isCacheFile(name string) bool {
+	if strings.HasPrefix(name, tempPrefix) {
+		return true
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && len(name) == sha256.Size*2
+}
+
+func (b *CachedBackend) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(b.dir, hex.EncodeToString(sum[:]))
+}
+
+// remove drops the entry in el. The caller must hold b.mu.
+func (b *CachedBackend) remove(el *list.Element) {
+	e := b.lru.Remove(el).(*entry)
+	delete(b.items, e.key)
+	if e.size >= 0 {
+		b.used -= e.size
+		os.Remove(b.path(e.key))
+	}
+}
+
+// add caches e, evicting the least recently used entries if the cache is
+// full. The caller must hold b.mu.
+func (b *CachedBackend) add(e *entry) {
+	if el, ok := b.items[e.key]; ok {
+		b.remove(el)
+	}
+	b.items[e.key] = b.lru.PushFront(e)
+	if e.size >= 0 {
+		b.used += e.size
+	}
+
+	for b.lru.Len() > 0 && (b.used > b.maxSize || b.lru.Len() > maxEntries) {
+		b.remove(b.lru.Back())
+	}
+}
+
+// startRead registers a read of key from the inner backend, returning the
+// generation to check its result against. The caller must hold b.mu.
+func (b *CachedBackend) startRead(key string) uint64 {
+	b.readers[key]++
+	return b.gens[key]
+}
+
+// endRead unregisters a read started with startRead. The caller must hold
+// b.mu.
+func (b *CachedBackend) endRead(key string) {
+	b.readers[key]--
+	if b.readers[key] == 0 {
+		delete(b.readers, key)
+		delete(b.gens, key)
+	}
+}
+
+// changed makes reads of key in progress discard what they read, which
+// may be stale. The caller must hold b.mu.
+func (b *CachedBackend) changed(key string) {
+	if b.readers[key] > 0 {
+		b.gens[key]++
+	}
+}
+
+func (b *CachedBackend) invalidate(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.changed(key)
+	if el, ok := b.items[key]; ok {
+		b.remove(el)
+	}
+}
+
+// fetch reads the contents of key from the inner backend into the cache,
+// returning the file they were written to.
+func (b *CachedBackend) fetch(key string, gen uint64) (m backends.Metadata, modtime time.Time, f *os.File, err error) {
+	if mt, ok := b.inner.(modTimer); ok {
+		modtime, err = mt.ModTime(key)
+		if err != nil {
+			return
+		}
+	}
+
+	m, r, err := b.inner.Get(key)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	f, err = ioutil.TempFile(b.dir, tempPrefix)
+	if err != nil {
+		return
+	}
+	size, err := io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return m, modtime, nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The file was changed while it was being read, it can still be
+	// returned but should not be kept
+	if gen != b.gens[key] {
+		os.Remove(f.Name())
+		return
+	}
+
+	if err = os.Rename(f.Name(), b.path(key)); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return m, modtime, nil, err
+	}
+	b.add(&entry{key: key, metadata: m, size: size, modtime: modtime})
+	return
+}
+
+// open returns the metadata, modification time and cached contents of key,
+// reading them from the inner backend first if needed.
+func (b *CachedBackend) open(key string) (m backends.Metadata, modtime time.Time, f *os.File, err error) {
+	for {
+		b.mu.Lock()
+		if el, ok := b.items[key]; ok && el.Value.(*entry).size >= 0 {
+			b.lru.MoveToFront(el)
+			b.stats.Hits++
+			m = el.Value.(*entry).metadata
+			modtime = el.Value.(*entry).modtime
+			f, err = os.Open(b.path(key))
+			b.mu.Unlock()
+			return
+		}
+
+		// only read each file once when it is requested many times at once
+		if wait, ok := b.filling[key]; ok {
+			b.mu.Unlock()
+			<-wait
+			continue
+		}
+
+		b.stats.Misses++
+		done := make(chan struct{})
+		b.filling[key] = done
+		gen := b.startRead(key)
+		b.mu.Unlock()
+
+		m, modtime, f, err = b.fetch(key, gen)
+
+		b.mu.Lock()
+		b.endRead(key)
+		delete(b.filling, key)
+		close(done)
+		b.mu.Unlock()
+		return
+	}
+}
+
+func (b *CachedBackend) Delete(key string) error {
+	err := b.inner.Delete(key)
+	b.invalidate(key)
+	return err
+}
+
+func (b *CachedBackend) Exists(key string) (bool, error) {
+	b.mu.Lock()
+	_, ok := b.items[key]
+	b.mu.Unlock()
+
+	if ok {
+		return true, nil
+	}
+	return b.inner.Exists(key)
+}
+
+func (b *CachedBackend) Head(key string) (backends.Metadata, error) {
+	b.mu.Lock()
+	if el, ok := b.items[key]; ok {
+		b.lru.MoveToFront(el)
+		b.stats.MetadataHits++
+		m := el.Value.(*entry).metadata
+		b.mu.Unlock()
+		return m, nil
+	}
+	b.stats.MetadataMisses++
+	gen := b.startRead(key)
+	b.mu.Unlock()
+
+	m, err := b.inner.Head(key)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.items[key]; err == nil && !ok && gen == b.gens[key] {
+		b.add(&entry{key: key, metadata: m, size: -1})
+	}
+	b.endRead(key)
+	return m, err
+}
+
+// Get returns the cached contents of files that fit in the cache, reading
+// them into it first if needed.
+func (b *CachedBackend) Get(key string) (backends.Metadata, io.ReadCloser, error) {
+	m, err := b.Head(key)
+	if err != nil {
+		return m, nil, err
+	}
+	if m.Size > b.maxSize {
+		return b.inner.Get(key)
+	}
+
+	m, _, f, err := b.open(key)
+	if err != nil {
+		return m, nil, err
+	}
+	return m, f, nil
+}
+
+func (b *CachedBackend) Put(key string, r io.Reader, meta backends.Metadata) (backends.Metadata, error) {
+	m, err := b.inner.Put(key, r, meta)
+	b.invalidate(key)
+	return m, err
+}
+
+// PutMetadata keeps the cached contents of the file, which are unchanged.
+func (b *CachedBackend) PutMetadata(key string, m backends.Metadata) error {
+	err := b.inner.PutMetadata(key, m)
+	if err != nil {
+		b.invalidate(key)
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.changed(key)
+	if el, ok := b.items[key]; ok {
+		el.Value.(*entry).metadata = m
+	}
+	return nil
+}
+
+func (b *CachedBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) error {
+	m, err := b.Head(key)
+	if err != nil {
+		return err
+	}
+	if m.Size > b.maxSize {
+		return b.inner.ServeFile(key, w, r)
+	}
+
+	_, modtime, f, err := b.open(key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, key, modtime, f)
+	return nil
+}
+
+func (b *CachedBackend) Size(key string) (int64, error) {
+	b.mu.Lock()
+	size := int64(-1)
+	if el, ok := b.items[key]; ok {
+		size = el.Value.(*entry).size
+	}
+	b.mu.Unlock()
+
+	if size >= 0 {
+		return size, nil
+	}
+	return b.inner.Size(key)
+}
+
+func (b *CachedBackend) List(fn func(key string) error) error {
+	return b.inner.List(fn)
+}
+
+// Stats returns the hit and miss counts since the cache was created.
+func (b *CachedBackend) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := b.stats
+	stats.Used = b.used
+	return stats
+}
+
+// PeriodicLogStats logs the hit and miss counts at every interval.
+func (b *CachedBackend) PeriodicLogStats(interval time.Duration) {
+	for range time.Tick(interval) {
+		s := b.Stats()
+		log.Printf("Cache: %d hits, %d misses, %d metadata hits, %d metadata misses, %d bytes used",
+			s.Hits, s.Misses, s.MetadataHits, s.MetadataMisses, s.Used)
+	}
+}
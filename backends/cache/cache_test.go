@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
+)
+
+// countingBackend counts the reads that reach the backend behind the cache
+type countingBackend struct {
+	*memory.MemoryBackend
+	heads, gets int
+}
+
+func (b *countingBackend) Head(key string) (backends.Metadata, error) {
+	b.heads++
+	return b.MemoryBackend.Head(key)
+}
+
+func (b *countingBackend) Get(key string) (backends.Metadata, io.ReadCloser, error) {
+	b.gets++
+	return b.MemoryBackend.Get(key)
+}
+
+func newTestBackend(t *testing.T, maxSize int64) (*CachedBackend, *countingBackend, func()) {
+	dir, err := ioutil.TempDir("", "linx-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner := &countingBackend{MemoryBackend: memory.NewMemoryBackend(0)}
+	b, err := NewCachedBackend(inner, dir, maxSize)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return b, inner, func() { os.RemoveAll(dir) }
+}
+
+func readAll(t *testing.T, b backends.StorageBackend, key string) string {
+	_, r, err := b.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	data, _ := ioutil.ReadAll(r)
+	return string(data)
+}
+
+func TestReadThrough(t *testing.T) {
+	b, inner, done := newTestBackend(t, 1000)
+	defer done()
+
+	_, err := b.Put("test.txt", strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if readAll(t, b, "test.txt") != "File content" {
+			t.Fatal("Read back the wrong contents")
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/selif/test.txt", nil)
+	req.Header.Set("Range", "bytes=5-11")
+	w := httptest.NewRecorder()
+	if err = b.ServeFile("test.txt", w, req); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusPartialContent || w.Body.String() != "content" {
+		t.Fatalf("Range request returned %d %q", w.Code, w.Body.String())
+	}
+
+	if inner.gets != 1 || inner.heads != 1 {
+		t.Fatalf("Backend was read %d times and its metadata %d times", inner.gets, inner.heads)
+	}
+	stats := b.Stats()
+	if stats.Hits != 3 || stats.Misses != 1 || stats.MetadataHits != 3 || stats.MetadataMisses != 1 || stats.Used != 12 {
+		t.Fatalf("Stats were %+v", stats)
+	}
+}
+
+func TestModTime(t *testing.T) {
+	b, inner, done := newTestBackend(t, 1000)
+	defer done()
+
+	_, err := b.Put("test.txt", strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	modtime, err := inner.ModTime("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(ifRange string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/selif/test.txt", nil)
+		req.Header.Set("Range", "bytes=5-11")
+		req.Header.Set("If-Range", ifRange)
+		w := httptest.NewRecorder()
+		if err := b.ServeFile("test.txt", w, req); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	// once from the backend, then from the cache
+	for i := 0; i < 2; i++ {
+		w := serve(modtime.UTC().Format(http.TimeFormat))
+		if w.Header().Get("Last-Modified") != modtime.UTC().Format(http.TimeFormat) {
+			t.Fatalf("Last-Modified was %q", w.Header().Get("Last-Modified"))
+		}
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("Range matching If-Range returned %d", w.Code)
+		}
+	}
+
+	if w := serve(modtime.Add(-time.Hour).UTC().Format(http.TimeFormat)); w.Code != http.StatusOK {
+		t.Fatalf("Range with an outdated If-Range returned %d", w.Code)
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	b, inner, done := newTestBackend(t, 1000)
+	defer done()
+
+	_, err := b.Put("test.txt", strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := b.Head("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, b, "test.txt")
+
+	// the contents stay cached when only the metadata changes
+	m.Mimetype = "text/x-go"
+	if err = b.PutMetadata("test.txt", m); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ = b.Head("test.txt"); m.Mimetype != "text/x-go" {
+		t.Fatal("Metadata was not updated")
+	}
+	gets := inner.gets
+	if readAll(t, b, "test.txt") != "File content" || inner.gets != gets {
+		t.Fatal("Contents were dropped from the cache by PutMetadata")
+	}
+	if m, _, _ = b.Get("test.txt"); m.Mimetype != "text/x-go" {
+		t.Fatal("Get returned stale metadata")
+	}
+
+	_, err = b.Put("test.txt", strings.NewReader("New content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readAll(t, b, "test.txt") != "New content" {
+		t.Fatal("Contents were not invalidated")
+	}
+
+	if err = b.Delete("test.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Head("test.txt"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr after Delete, got %v", err)
+	}
+	if b.Stats().Used != 0 {
+		t.Fatal("Deleted file is still cached")
+	}
+}
+
+// blockingBackend holds reads until they are released
+type blockingBackend struct {
+	*memory.MemoryBackend
+	release chan struct{}
+}
+
+func (b blockingBackend) Get(key string) (backends.Metadata, io.ReadCloser, error) {
+	<-b.release
+	return b.MemoryBackend.Get(key)
+}
+
+func TestChangeDuringFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linx-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := blockingBackend{memory.NewMemoryBackend(0), make(chan struct{})}
+	b, err := NewCachedBackend(inner, dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a.txt", "b.txt"} {
+		_, err := b.Put(key, strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fetched := make(chan struct{})
+	go func() {
+		if _, r, err := b.Get("a.txt"); err == nil {
+			ioutil.ReadAll(r)
+			r.Close()
+		}
+		close(fetched)
+	}()
+
+	// wait for the fetch to start
+	for {
+		b.mu.Lock()
+		_, filling := b.filling["a.txt"]
+		b.mu.Unlock()
+		if filling {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// changes to other files don't affect it
+	m, _ := b.Head("b.txt")
+	if err = b.PutMetadata("b.txt", m); err != nil {
+		t.Fatal(err)
+	}
+	close(inner.release)
+	<-fetched
+
+	if b.Stats().Used != int64(len("File content")) {
+		t.Fatal("Fetched file was not kept after another file changed")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	b, inner, done := newTestBackend(t, 25)
+	defer done()
+
+	for _, key := range []string{"a.txt", "b.txt", "c.txt"} {
+		_, err := b.Put(key, strings.NewReader("0123456789"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, b, key)
+	}
+	if b.Stats().Used != 20 {
+		t.Fatalf("Cache holds %d bytes", b.Stats().Used)
+	}
+
+	gets := inner.gets
+	readAll(t, b, "c.txt")
+	readAll(t, b, "a.txt")
+	if inner.gets != gets+1 {
+		t.Fatal("Least recently used file was not the one evicted")
+	}
+
+	// too large to be cached at all
+	_, err := b.Put("large.txt", strings.NewReader(strings.Repeat("0123456789", 3)), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readAll(t, b, "large.txt") != strings.Repeat("0123456789", 3) || b.Stats().Used != 20 {
+		t.Fatal("Large file was not read around the cache")
+	}
+}
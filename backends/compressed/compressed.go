@@ -0,0 +1,302 @@
+package compressed
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/helpers"
+)
+
+const gzipEncoding = "gzip"
+
+var errUnknownEncoding = errors.New("compressed: unknown encoding")
+var errInvalidSeek = errors.New("compressed: invalid seek")
+
+// CompressedBackend stores files of compressible types gzipped in another
+// backend. Clients that accept gzip get the stored bytes as they are,
+// everyone else gets them decompressed on the fly.
+type CompressedBackend struct {
+	inner backends.MetaStorageBackend
+	level int
+}
+
+func NewCompressedBackend(inner backends.MetaStorageBackend, level int) CompressedBackend {
+	return CompressedBackend{inner: inner, level: level}
+}
+
+// compressible reports whether files of mimetype are worth compressing.
+func compressible(mimetype string) bool {
+	mimetype = strings.TrimSpace(strings.Split(mimetype, ";")[0])
+
+	if strings.HasPrefix(mimetype, "text/") ||
+		strings.HasSuffix(mimetype, "+xml") ||
+		strings.HasSuffix(mimetype, "+json") {
+		return true
+	}
+
+	switch mimetype {
+	case "application/json", "application/xml", "application/javascript",
+		"application/x-javascript", "application/x-sh", "application/x-ndjson",
+		"application/sql":
+		return true
+	}
+	return false
+}
+
+// acceptsGzip reports whether a client sending the given Accept-Encoding
+// header can be sent gzipped contents.
+func acceptsGzip(header string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != gzipEncoding && name != "*" {
+			continue
+		}
+
+		accepted := true
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				accepted = err == nil && q > 0
+			}
+		}
+		return accepted
+	}
+	return false
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decode returns a reader for the original contents of a file stored with
+// the given encoding.
+func decode(r io.Reader, encoding string) (io.Reader, error) {
+	switch encoding {
+	case "":
+		return r, nil
+	case gzipEncoding:
+		return gzip.NewReader(r)
+	}
+	return nil, errUnknownEncoding
+}
+
+func (b CompressedBackend) Delete(key string) error {
+	return b.inner.Delete(key)
+}
+
+func (b CompressedBackend) Exists(key string) (bool, error) {
+	return b.inner.Exists(key)
+}
+
+func (b CompressedBackend) Head(key string) (backends.Metadata, error) {
+	return b.inner.Head(key)
+}
+
+// Get returns the original contents of the file, so the returned metadata
+// has no encoding.
+func (b CompressedBackend) Get(key string) (m backends.Metadata, r io.ReadCloser, err error) {
+	m, body, err := b.inner.Get(key)
+	if err != nil {
+		return
+	}
+
+	decoded, err := decode(body, m.Encoding)
+	if err != nil {
+		body.Close()
+		return
+	}
+
+	m.Encoding = ""
+	return m, readCloser{decoded, body}, nil
+}
+
+func (b CompressedBackend) Put(key string, r io.Reader, meta backends.Metadata) (m backends.Metadata, err error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(r, header)
+	if n == 0 {
+		return m, backends.FileEmptyError
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return m, err
+	}
+	r = io.MultiReader(bytes.NewReader(header[:n]), r)
+
+	sniffer := helpers.NewMetadataHasher()
+	sniffer.Write(header[:n])
+	if !compressible(sniffer.Metadata().Mimetype) {
+		return b.inner.Put(key, r, meta)
+	}
+
+	// The inner backend gets the metadata of the original contents right
+	// away, only their size and checksum are known once they are stored
+	stored := meta
+	stored.Encoding = gzipEncoding
+	if stored.Mimetype == "" {
+		stored.Mimetype = sniffer.Metadata().Mimetype
+	}
+
+	hasher := helpers.NewMetadataHasher()
+	pr, pw := io.Pipe()
+	go func() {
+		gz, err := gzip.NewWriterLevel(pw, b.level)
+		if err == nil {
+			_, err = io.Copy(gz, io.TeeReader(r, hasher))
+		}
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	_, err = b.inner.Put(key, pr, stored)
+	pr.Close()
+	if err != nil {
+		return
+	}
+
+	// The inner backend described the compressed bytes
+	m = hasher.Complete(stored)
+
+	err = b.inner.PutMetadata(key, m)
+	return
+}
+
+func (b CompressedBackend) PutMetadata(key string, m backends.Metadata) error {
+	// Callers only know about the original contents, keep track of how
+	// they are stored
+	stored, err := b.inner.Head(key)
+	if err != nil {
+		return err
+	}
+	m.Encoding = stored.Encoding
+
+	return b.inner.PutMetadata(key, m)
+}
+
+func (b CompressedBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) error {
+	m, err := b.inner.Head(key)
+	if err != nil {
+		return err
+	}
+	if m.Encoding == "" {
+		return b.inner.ServeFile(key, w, r)
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if m.Encoding == gzipEncoding && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		// The response is a different representation of the file, whose
+		// length is only known to the inner backend
+		if etag := w.Header().Get("Etag"); strings.HasSuffix(etag, "\"") {
+			w.Header().Set("Etag", strings.TrimSuffix(etag, "\"")+"-"+gzipEncoding+"\"")
+		}
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", m.Encoding)
+		return b.inner.ServeFile(key, w, r)
+	}
+
+	content := &decodingReader{b: b, key: key, encoding: m.Encoding, size: m.Size}
+	defer content.Close()
+	http.ServeContent(w, r, key, time.Time{}, content)
+	return nil
+}
+
+func (b CompressedBackend) Size(key string) (int64, error) {
+	m, err := b.inner.Head(key)
+	if err != nil {
+		return 0, err
+	}
+	return m.Size, nil
+}
+
+func (b CompressedBackend) List(fn func(key string) error) error {
+	return b.inner.List(fn)
+}
+
+// decodingReader lets http.ServeContent seek within the decompressed
+// contents of a file. Seeking forward decompresses and discards, seeking
+// backward starts over.
+type decodingReader struct {
+	b        CompressedBackend
+	key      string
+	encoding string
+	size     int64
+
+	offset int64
+	pos    int64
+	body   io.ReadCloser
+	r      io.Reader
+}
+
+func (d *decodingReader) Read(p []byte) (n int, err error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+
+	if d.body != nil && d.offset < d.pos {
+		d.Close()
+	}
+	if d.body == nil {
+		_, d.body, err = d.b.inner.Get(d.key)
+		if err != nil {
+			return
+		}
+		d.r, err = decode(d.body, d.encoding)
+		if err != nil {
+			return
+		}
+		d.pos = 0
+	}
+
+	if d.offset > d.pos {
+		skipped, err := io.CopyN(ioutil.Discard, d.r, d.offset-d.pos)
+		d.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err = d.r.Read(p)
+	d.pos += int64(n)
+	d.offset = d.pos
+	return
+}
+
+func (d *decodingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errInvalidSeek
+	}
+	if offset < 0 {
+		return 0, errInvalidSeek
+	}
+
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *decodingReader) Close() error {
+	if d.body == nil {
+		return nil
+	}
+
+	err := d.body.Close()
+	d.body = nil
+	d.r = nil
+	return err
+}
@@ -0,0 +1,152 @@
+package compressed
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
+)
+
+func TestPutAndGet(t *testing.T) {
+	inner := memory.NewMemoryBackend(0)
+	b := NewCompressedBackend(inner, gzip.DefaultCompression)
+
+	text := strings.Repeat("File content\n", 1000)
+	m, err := b.Put("test.txt", strings.NewReader(text), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey", AccessKey: "acckey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != int64(len(text)) || m.Encoding != "gzip" {
+		t.Fatalf("Wrong metadata %+v", m)
+	}
+
+	stored, err := inner.Size("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored >= int64(len(text)) {
+		t.Fatalf("Stored %d bytes for %d bytes of text", stored, len(text))
+	}
+
+	m, r, err := b.Get("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != text || m.Encoding != "" || m.DeleteKey != "delkey" || m.AccessKey != "acckey" {
+		t.Fatalf("Read back wrong contents or metadata %+v", m)
+	}
+
+	if s, _ := b.Size("test.txt"); s != int64(len(text)) {
+		t.Fatalf("Size returned %d instead of %d", s, len(text))
+	}
+
+	m.Mimetype = "text/x-go"
+	if err = b.PutMetadata("test.txt", m); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ = b.Head("test.txt"); m.Encoding != "gzip" {
+		t.Fatal("PutMetadata lost the encoding")
+	}
+}
+
+func TestBinaryNotCompressed(t *testing.T) {
+	inner := memory.NewMemoryBackend(0)
+	b := NewCompressedBackend(inner, gzip.DefaultCompression)
+
+	data := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 1000)...)
+	_, err := b.Put("test.png", bytes.NewReader(data), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := inner.Head("test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Encoding != "" || m.Size != int64(len(data)) {
+		t.Fatalf("Binary file was compressed %+v", m)
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	b := NewCompressedBackend(memory.NewMemoryBackend(0), gzip.DefaultCompression)
+
+	text := strings.Repeat("File content\n", 1000)
+	_, err := b.Put("test.txt", strings.NewReader(text), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/selif/test.txt", nil)
+	req.Header.Set("Accept-Encoding", "deflate, gzip")
+	w := httptest.NewRecorder()
+	w.Header().Set("Etag", "\"abc\"")
+	if err = b.ServeFile("test.txt", w, req); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("Wrong headers %v", w.Header())
+	}
+	if w.Header().Get("Etag") != "\"abc-gzip\"" {
+		t.Fatalf("Etag was %s", w.Header().Get("Etag"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(gz)
+	if string(data) != text {
+		t.Fatal("Gzipped response has the wrong contents")
+	}
+
+	req = httptest.NewRequest("GET", "/selif/test.txt", nil)
+	w = httptest.NewRecorder()
+	if err = b.ServeFile("test.txt", w, req); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != text {
+		t.Fatal("Response without Accept-Encoding was not decompressed")
+	}
+
+	for _, rng := range []struct {
+		header     string
+		start, end int
+	}{
+		{"bytes=5000-5100", 5000, 5100},
+		{"bytes=-20", len(text) - 20, len(text) - 1},
+	} {
+		req = httptest.NewRequest("GET", "/selif/test.txt", nil)
+		req.Header.Set("Range", rng.header)
+		w = httptest.NewRecorder()
+		if err = b.ServeFile("test.txt", w, req); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusPartialContent || w.Body.String() != text[rng.start:rng.end+1] {
+			t.Fatalf("%s returned %d with the wrong bytes", rng.header, w.Code)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, GZIP;q=0.5": true,
+		"gzip;q=0":            false,
+		"*":                   true,
+		"br, deflate":         false,
+	} {
+		if acceptsGzip(header) != expected {
+			t.Fatalf("acceptsGzip(%q) should be %v", header, expected)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package backends
+
+import (
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/minio/sha256-simd"
+)
+
+// SameMetadata reports whether a and b describe the same stored file with
+// the same settings.
+func SameMetadata(a, b Metadata) bool {
+	return a.DeleteKey == b.DeleteKey &&
+		a.AccessKey == b.AccessKey &&
+		a.Sha256sum == b.Sha256sum &&
+		a.Mimetype == b.Mimetype &&
+		a.Size == b.Size &&
+		a.Expiry.Unix() == b.Expiry.Unix() &&
+		a.Encoding == b.Encoding &&
+		a.Encrypted == b.Encrypted &&
+		a.MaxDownloads == b.MaxDownloads &&
+		a.Downloads == b.Downloads &&
+		a.Deadline.Unix() == b.Deadline.Unix() &&
+		strings.Join(a.ArchiveFiles, "\x00") == strings.Join(b.ArchiveFiles, "\x00")
+}
+
+// CopyFile stores the file and metadata of key in src on dst, returning
+// the sha256 of the bytes that were copied, which differs from the one in
+// the metadata for compressed or encrypted files.
+func CopyFile(src, dst StorageBackend, key string) (sum string, err error) {
+	m, r, err := src.Get(key)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	_, err = dst.Put(key, io.TeeReader(r, hasher), m)
+	if err != nil {
+		return
+	}
+
+	// Put describes the bytes it was given, restore the metadata of the
+	// source, such as its checksum, archive listing and encoding
+	err = dst.PutMetadata(key, m)
+	return hex.EncodeToString(hasher.Sum(nil)), err
+}
@@ -0,0 +1,267 @@
+package encrypted
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/helpers"
+)
+
+// EncryptedBackend encrypts files and their metadata before handing them
+// to another backend. Only the expiry and size of files are stored in the
+// clear, so that cleanup keeps working.
+type EncryptedBackend struct {
+	inner backends.MetaStorageBackend
+	keys  *Keyring
+}
+
+func NewEncryptedBackend(inner backends.MetaStorageBackend, keys *Keyring) EncryptedBackend {
+	return EncryptedBackend{inner: inner, keys: keys}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (b EncryptedBackend) sealMetadata(key string, m backends.Metadata) (sealed backends.Metadata, err error) {
+	sealed = m
+	sealed.Encrypted = true
+	fields := map[string]*string{
+		"delete_key": &sealed.DeleteKey,
+		"access_key": &sealed.AccessKey,
+		"sha256sum":  &sealed.Sha256sum,
+		"mimetype":   &sealed.Mimetype,
+	}
+	for field, value := range fields {
+		*value, err = b.keys.seal(key, field, *value)
+		if err != nil {
+			return
+		}
+	}
+
+	sealed.ArchiveFiles = make([]string, len(m.ArchiveFiles))
+	for i, name := range m.ArchiveFiles {
+		sealed.ArchiveFiles[i], err = b.keys.seal(key, "archive_files", name)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (b EncryptedBackend) unsealMetadata(key string, sealed backends.Metadata) (m backends.Metadata, err error) {
+	// callers only ever see the file decrypted
+	m = sealed
+	m.Encrypted = false
+	fields := map[string]*string{
+		"delete_key": &m.DeleteKey,
+		"access_key": &m.AccessKey,
+		"sha256sum":  &m.Sha256sum,
+		"mimetype":   &m.Mimetype,
+	}
+	for field, value := range fields {
+		*value, err = b.keys.unseal(key, field, *value)
+		if err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	m.ArchiveFiles = make([]string, len(sealed.ArchiveFiles))
+	for i, name := range sealed.ArchiveFiles {
+		m.ArchiveFiles[i], err = b.keys.unseal(key, "archive_files", name)
+		if err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+	return
+}
+
+// sealedWithCurrent reports whether all metadata of a file is sealed with
+// the current master key, and marked as such.
+func (b EncryptedBackend) sealedWithCurrent(sealed backends.Metadata) bool {
+	if !sealed.Encrypted {
+		return false
+	}
+	for _, value := range append([]string{sealed.DeleteKey, sealed.AccessKey, sealed.Sha256sum, sealed.Mimetype}, sealed.ArchiveFiles...) {
+		if !b.keys.isSealed(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b EncryptedBackend) Delete(key string) error {
+	return b.inner.Delete(key)
+}
+
+func (b EncryptedBackend) Exists(key string) (bool, error) {
+	return b.inner.Exists(key)
+}
+
+func (b EncryptedBackend) Head(key string) (m backends.Metadata, err error) {
+	m, err = b.inner.Head(key)
+	if err != nil {
+		return
+	}
+	return b.unsealMetadata(key, m)
+}
+
+func (b EncryptedBackend) Get(key string) (m backends.Metadata, r io.ReadCloser, err error) {
+	m, body, err := b.inner.Get(key)
+	if err != nil {
+		return
+	}
+
+	m, err = b.unsealMetadata(key, m)
+	if err != nil {
+		body.Close()
+		return
+	}
+
+	br := bufio.NewReader(body)
+	prefix, _ := br.Peek(len(magic))
+	if !isEncrypted(prefix) {
+		// stored before encryption was enabled
+		return m, readCloser{br, body}, nil
+	}
+
+	h, err := b.keys.readHeader(br, key)
+	if err != nil {
+		body.Close()
+		return
+	}
+	return m, readCloser{newDecrypter(br, h), body}, nil
+}
+
+func (b EncryptedBackend) Put(key string, r io.Reader, meta backends.Metadata) (m backends.Metadata, err error) {
+	br := bufio.NewReader(r)
+	if _, err = br.Peek(1); err == io.EOF {
+		return m, backends.FileEmptyError
+	} else if err != nil {
+		return
+	}
+
+	h, err := b.keys.newHeader(key)
+	if err != nil {
+		return
+	}
+
+	// The inner backend gets the metadata given by the caller right away,
+	// the rest of it is only known once the upload is complete
+	sealed, err := b.sealMetadata(key, meta)
+	if err != nil {
+		return
+	}
+
+	hasher := helpers.NewMetadataHasher()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encrypt(pw, io.TeeReader(br, hasher), h))
+	}()
+
+	_, err = b.inner.Put(key, pr, sealed)
+	pr.Close()
+	if err != nil {
+		return
+	}
+
+	m = hasher.Complete(meta)
+
+	if helpers.IsArchive(m.Mimetype) {
+		var rr *rangeReader
+		rr, _, err = b.openRange(key)
+		if err != nil {
+			return
+		}
+		m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, rr)
+		rr.Close()
+	}
+
+	err = b.PutMetadata(key, m)
+	return
+}
+
+func (b EncryptedBackend) PutMetadata(key string, m backends.Metadata) error {
+	sealed, err := b.sealMetadata(key, m)
+	if err != nil {
+		return err
+	}
+	return b.inner.PutMetadata(key, sealed)
+}
+
+func (b EncryptedBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) error {
+	_, err := b.inner.Head(key)
+	if err != nil {
+		return err
+	}
+
+	content, ok, err := b.openRange(key)
+	if err != nil {
+		return err
+	} else if !ok {
+		return b.inner.ServeFile(key, w, r)
+	}
+	defer content.Close()
+
+	http.ServeContent(w, r, key, time.Time{}, content)
+	return nil
+}
+
+func (b EncryptedBackend) Size(key string) (int64, error) {
+	m, err := b.Head(key)
+	if err != nil {
+		return 0, err
+	}
+	return m.Size, nil
+}
+
+func (b EncryptedBackend) List(fn func(key string) error) error {
+	return b.inner.List(fn)
+}
+
+// Reencrypt makes sure the file stored under key and its metadata are
+// encrypted with the current master key, rewriting them if needed. Files
+// stored before encryption was enabled are encrypted.
+func (b EncryptedBackend) Reencrypt(key string) (changed bool, err error) {
+	sealed, err := b.inner.Head(key)
+	if err != nil {
+		return
+	}
+
+	content, ok, err := b.openRange(key)
+	if err != nil {
+		return
+	}
+	if ok {
+		content.Close()
+		if content.h.keyID == b.keys.Current() {
+			if b.sealedWithCurrent(sealed) {
+				return false, nil
+			}
+
+			m, err := b.unsealMetadata(key, sealed)
+			if err != nil {
+				return false, err
+			}
+			return true, b.PutMetadata(key, m)
+		}
+	}
+
+	m, r, err := b.Get(key)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	_, err = b.Put(key, r, m)
+	if err != nil {
+		return
+	}
+
+	// keep what was set since the upload, such as a changed mimetype
+	return true, b.PutMetadata(key, m)
+}
@@ -0,0 +1,289 @@
+package encrypted
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/memory"
+)
+
+const (
+	testKey1 = "k1 AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	testKey2 = "k2 HxwdGxoZGBcWFRQTEhEQDw4NDAsKCQgHBgUEAwIBAAA="
+)
+
+func newKeyring(t *testing.T, lines ...string) *Keyring {
+	k, err := ParseKeyring(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func readAll(t *testing.T, b backends.StorageBackend, key string) (backends.Metadata, []byte) {
+	m, r, err := b.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, data
+}
+
+func TestPutAndGet(t *testing.T) {
+	inner := memory.NewMemoryBackend(0)
+	b := NewEncryptedBackend(inner, newKeyring(t, testKey1))
+
+	for _, size := range []int{1, chunkSize, 3*chunkSize + 100} {
+		data := randomData(size)
+		m, err := b.Put("test.bin", bytes.NewReader(data), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey", AccessKey: "acckey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Size != int64(size) {
+			t.Fatalf("Wrong size %d instead of %d", m.Size, size)
+		}
+
+		m, got := readAll(t, b, "test.bin")
+		if !bytes.Equal(got, data) {
+			t.Fatalf("Read back different contents for %d bytes", size)
+		}
+		if m.DeleteKey != "delkey" || m.AccessKey != "acckey" || m.Size != int64(size) {
+			t.Fatalf("Wrong metadata %+v", m)
+		}
+
+		if s, _ := b.Size("test.bin"); s != int64(size) {
+			t.Fatalf("Size returned %d instead of %d", s, size)
+		}
+	}
+
+	sealed, err := inner.Head("test.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{sealed.DeleteKey, sealed.AccessKey, sealed.Sha256sum, sealed.Mimetype} {
+		if !strings.HasPrefix(value, sealPrefix+"k1:") {
+			t.Fatalf("Metadata value %q was stored unencrypted", value)
+		}
+	}
+	if !sealed.Encrypted {
+		t.Fatal("Stored metadata was not marked as encrypted")
+	}
+
+	_, err = b.Put("empty.txt", strings.NewReader(""), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != backends.FileEmptyError {
+		t.Fatalf("Expected FileEmptyError, got %v", err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	inner := memory.NewMemoryBackend(0)
+	b := NewEncryptedBackend(inner, newKeyring(t, testKey1))
+
+	_, err := b.Put("test.bin", bytes.NewReader(randomData(2*chunkSize+10)), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := inner.Head("test.bin")
+	_, raw := readAll(t, inner, "test.bin")
+
+	flipped := append([]byte{}, raw...)
+	flipped[len(flipped)-20] ^= 1
+	truncated := raw[:len(raw)-10-overhead]
+
+	for _, stored := range [][]byte{flipped, truncated} {
+		_, err = inner.Put("test.bin", bytes.NewReader(stored), backends.Metadata{Expiry: time.Unix(0, 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inner.PutMetadata("test.bin", sealed)
+
+		_, r, err := b.Get("test.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(r)
+		r.Close()
+		if err != errCorrupt {
+			t.Fatalf("Expected errCorrupt, got %v", err)
+		}
+	}
+}
+
+func TestServeFileRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linx-encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := randomData(3*chunkSize + 100)
+	inners := []backends.MetaStorageBackend{
+		memory.NewMemoryBackend(0),
+		localfs.NewLocalfsBackend(path.Join(dir, "meta"), path.Join(dir, "files")),
+	}
+	for _, inner := range inners {
+		b := NewEncryptedBackend(inner, newKeyring(t, testKey1))
+		_, err := b.Put("test.bin", bytes.NewReader(data), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, rng := range []struct {
+			header     string
+			start, end int
+		}{
+			{"bytes=10-20", 10, 20},
+			{"bytes=65530-65545", chunkSize - 6, chunkSize + 9},
+			{"bytes=-50", len(data) - 50, len(data) - 1},
+			{"bytes=100000-", 100000, len(data) - 1},
+		} {
+			req := httptest.NewRequest("GET", "/selif/test.bin", nil)
+			req.Header.Set("Range", rng.header)
+			w := httptest.NewRecorder()
+			err = b.ServeFile("test.bin", w, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != http.StatusPartialContent {
+				t.Fatalf("%T: %s returned %d", inner, rng.header, w.Code)
+			}
+			if !bytes.Equal(w.Body.Bytes(), data[rng.start:rng.end+1]) {
+				t.Fatalf("%T: %s returned the wrong bytes", inner, rng.header)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		err = b.ServeFile("test.bin", w, httptest.NewRequest("GET", "/selif/test.bin", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(w.Body.Bytes(), data) {
+			t.Fatalf("%T: full request returned the wrong bytes", inner)
+		}
+	}
+}
+
+func TestArchiveFiles(t *testing.T) {
+	b := NewEncryptedBackend(memory.NewMemoryBackend(0), newKeyring(t, testKey1))
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		f, _ := zw.Create(name)
+		f.Write([]byte("File content " + name))
+	}
+	zw.Close()
+
+	_, err := b.Put("test.zip", &buf, backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := b.Head("test.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(m.ArchiveFiles, ",") != "a.txt,b.txt" {
+		t.Fatalf("Listed archive files %v", m.ArchiveFiles)
+	}
+}
+
+func TestCheckEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linx-encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := localfs.NewLocalfsBackend(path.Join(dir, "meta"), path.Join(dir, "files"))
+	b := NewEncryptedBackend(inner, newKeyring(t, testKey1))
+	_, err = b.Put("test.bin", bytes.NewReader(randomData(100)), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the metadata describes the decrypted file, not what is on disk
+	err = inner.Check(true, func(issue localfs.Issue) {
+		t.Fatalf("%s: %s reported for an encrypted file", issue.Key, issue.Problem)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	inner := memory.NewMemoryBackend(0)
+	old := NewEncryptedBackend(inner, newKeyring(t, testKey1))
+
+	data := randomData(chunkSize + 10)
+	_, err := old.Put("old.bin", bytes.NewReader(data), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey", AccessKey: "acckey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = inner.Put("plain.txt", strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both keys are needed until everything is re-encrypted
+	rotated := NewEncryptedBackend(inner, newKeyring(t, testKey2, testKey1))
+	if _, got := readAll(t, rotated, "old.bin"); !bytes.Equal(got, data) {
+		t.Fatal("Could not read a file encrypted with the old key")
+	}
+	if _, got := readAll(t, rotated, "plain.txt"); string(got) != "File content" {
+		t.Fatal("Could not read a file stored before encryption")
+	}
+
+	for _, key := range []string{"old.bin", "plain.txt"} {
+		changed, err := rotated.Reencrypt(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !changed {
+			t.Fatalf("%s was not re-encrypted", key)
+		}
+
+		changed, err = rotated.Reencrypt(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed {
+			t.Fatalf("%s was re-encrypted twice", key)
+		}
+	}
+
+	current := NewEncryptedBackend(inner, newKeyring(t, testKey2))
+	m, got := readAll(t, current, "old.bin")
+	if !bytes.Equal(got, data) || m.AccessKey != "acckey" {
+		t.Fatal("Could not read a re-encrypted file with the new key alone")
+	}
+	if _, got := readAll(t, current, "plain.txt"); string(got) != "File content" {
+		t.Fatal("Could not read a file stored before encryption after re-encrypting it")
+	}
+	if _, raw := readAll(t, inner, "plain.txt"); !isEncrypted(raw) {
+		t.Fatal("File stored before encryption was not encrypted")
+	}
+}
@@ -0,0 +1,275 @@
+package encrypted
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Encrypted files start with a header holding a random data key, wrapped
+// with a master key:
+//
+//	magic | len(key id) | key id | nonce | sealed data key
+//
+// followed by the contents split into chunks of chunkSize bytes, each
+// sealed with AES-GCM under the data key. The chunk number is used as the
+// nonce, and whether it is the last chunk as additional data, so chunks
+// can't be reordered or dropped without being noticed. Every chunk can be
+// decrypted on its own, which is what makes ranged reads possible.
+const (
+	magic      = "LINXENC1"
+	chunkSize  = 64 * 1024
+	overhead   = 16 // GCM tag
+	nonceSize  = 12
+	dataKeyLen = 32
+
+	// the longest possible header
+	maxHeaderLen = len(magic) + 1 + 64 + nonceSize + dataKeyLen + overhead
+
+	// prefix of sealed metadata values
+	sealPrefix = "linxenc1:"
+)
+
+var errCorrupt = errors.New("encrypted: data is corrupt or was tampered with")
+
+// header is what is needed to read or write the chunks of a file.
+type header struct {
+	keyID string
+	aead  cipher.AEAD
+	raw   []byte
+}
+
+func (h header) len() int64 {
+	return int64(len(h.raw))
+}
+
+func wrapAAD(keyID, key string) []byte {
+	return []byte(magic + "\x00" + keyID + "\x00" + key)
+}
+
+// newHeader generates a data key for a new file stored under key.
+func (k *Keyring) newHeader(key string) (h header, err error) {
+	master, err := k.get(k.current)
+	if err != nil {
+		return
+	}
+
+	dataKey := make([]byte, dataKeyLen)
+	nonce := make([]byte, nonceSize)
+	if _, err = rand.Read(dataKey); err != nil {
+		return
+	}
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	h.keyID = k.current
+	h.aead, err = newAEAD(dataKey)
+	if err != nil {
+		return
+	}
+
+	raw := bytes.NewBufferString(magic)
+	raw.WriteByte(byte(len(k.current)))
+	raw.WriteString(k.current)
+	raw.Write(nonce)
+	raw.Write(master.Seal(nil, nonce, dataKey, wrapAAD(k.current, key)))
+	h.raw = raw.Bytes()
+	return
+}
+
+// isEncrypted reports whether the data starting with prefix is encrypted,
+// as opposed to a file stored before encryption was enabled.
+func isEncrypted(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte(magic))
+}
+
+// readHeader reads and unwraps the header of a file stored under key.
+func (k *Keyring) readHeader(r io.Reader, key string) (h header, err error) {
+	start := make([]byte, len(magic)+1)
+	if _, err = io.ReadFull(r, start); err != nil {
+		return h, errCorrupt
+	}
+	if !isEncrypted(start) {
+		return h, errCorrupt
+	}
+
+	rest := make([]byte, int(start[len(magic)])+nonceSize+dataKeyLen+overhead)
+	if _, err = io.ReadFull(r, rest); err != nil {
+		return h, errCorrupt
+	}
+	idLen := int(start[len(magic)])
+	h.keyID = string(rest[:idLen])
+	nonce := rest[idLen : idLen+nonceSize]
+
+	master, err := k.get(h.keyID)
+	if err != nil {
+		return
+	}
+	dataKey, err := master.Open(nil, nonce, rest[idLen+nonceSize:], wrapAAD(h.keyID, key))
+	if err != nil {
+		return h, errCorrupt
+	}
+
+	h.aead, err = newAEAD(dataKey)
+	h.raw = append(start, rest...)
+	return
+}
+
+func chunkNonce(n int64) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce[nonceSize-8:], uint64(n))
+	return nonce
+}
+
+func chunkAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encrypt writes the header followed by the encrypted contents of r to w.
+func encrypt(w io.Writer, r io.Reader, h header) error {
+	if _, err := w.Write(h.raw); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, chunkSize)
+	buf := make([]byte, chunkSize)
+	for n := int64(0); ; n++ {
+		size, err := io.ReadFull(br, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		} else if err != nil {
+			return err
+		}
+
+		_, err = br.Peek(1)
+		last := err == io.EOF
+		if err != nil && !last {
+			return err
+		}
+
+		_, err = w.Write(h.aead.Seal(nil, chunkNonce(n), buf[:size], chunkAAD(last)))
+		if err != nil || last {
+			return err
+		}
+	}
+}
+
+// decrypter decrypts the chunks of a whole file as they are read.
+type decrypter struct {
+	r    *bufio.Reader
+	h    header
+	n    int64
+	buf  []byte
+	done bool
+}
+
+func newDecrypter(r io.Reader, h header) *decrypter {
+	return &decrypter{r: bufio.NewReaderSize(r, chunkSize+overhead), h: h}
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		sealed := make([]byte, chunkSize+overhead)
+		size, err := io.ReadFull(d.r, sealed)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		_, err = d.r.Peek(1)
+		d.done = err == io.EOF
+		if err != nil && !d.done {
+			return 0, err
+		}
+
+		d.buf, err = d.h.aead.Open(sealed[:0], chunkNonce(d.n), sealed[:size], chunkAAD(d.done))
+		if err != nil {
+			return 0, errCorrupt
+		}
+		d.n++
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// plainSize returns the size of the contents of an encrypted file of size
+// bytes, along with its number of chunks.
+func plainSize(size int64, h header) (plain int64, chunks int64) {
+	sealed := size - h.len()
+	chunks = (sealed + chunkSize + overhead - 1) / (chunkSize + overhead)
+	return sealed - chunks*overhead, chunks
+}
+
+func metaAAD(key, field string) []byte {
+	return []byte("linx-meta\x00" + key + "\x00" + field)
+}
+
+// seal encrypts a metadata value of the file stored under key with the
+// current master key. Empty values are left empty.
+func (k *Keyring) seal(key, field, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	master, err := k.get(k.current)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := master.Seal(nonce, nonce, []byte(value), metaAAD(key, field))
+
+	return sealPrefix + k.current + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// isSealed reports whether value is sealed with the current key.
+func (k *Keyring) isSealed(value string) bool {
+	return value == "" || strings.HasPrefix(value, sealPrefix+k.current+":")
+}
+
+// unseal reverses seal. Values stored before encryption was enabled are
+// returned as they are.
+func (k *Keyring) unseal(key, field, value string) (string, error) {
+	if !strings.HasPrefix(value, sealPrefix) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, sealPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errCorrupt
+	}
+	master, err := k.get(parts[0])
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < nonceSize {
+		return "", errCorrupt
+	}
+	plain, err := master.Open(nil, sealed[:nonceSize], sealed[nonceSize:], metaAAD(key, field))
+	if err != nil {
+		return "", errCorrupt
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,103 @@
+package encrypted
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var errEmptyKeyring = errors.New("encrypted: no keys in key file")
+var errUnknownKey = errors.New("encrypted: data was encrypted with a key that is not in the key file")
+
+var keyIDRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Keyring holds the master keys. New data is always encrypted with the
+// current key; the others are only kept to read data that hasn't been
+// re-encrypted yet.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// LoadKeyring reads a key file, see ParseKeyring.
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseKeyring(f)
+}
+
+// ParseKeyring reads master keys, one per line as an id followed by 32
+// base64-encoded random bytes. The first key is the current one. Empty
+// lines and lines starting with # are ignored.
+func ParseKeyring(r io.Reader) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !keyIDRe.MatchString(fields[0]) {
+			return nil, fmt.Errorf("encrypted: line %d of key file is not an id followed by a key", n)
+		}
+		if _, ok := k.keys[fields[0]]; ok {
+			return nil, fmt.Errorf("encrypted: key id %s is used twice", fields[0])
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("encrypted: key %s is not 32 base64-encoded bytes", fields[0])
+		}
+
+		k.keys[fields[0]], err = newAEAD(raw)
+		if err != nil {
+			return nil, err
+		}
+		if k.current == "" {
+			k.current = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if k.current == "" {
+		return nil, errEmptyKeyring
+	}
+	return k, nil
+}
+
+// Current returns the id of the key new data is encrypted with.
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+func (k *Keyring) get(id string) (cipher.AEAD, error) {
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, errUnknownKey
+	}
+	return aead, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,267 @@
+package encrypted
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+var errInvalidSeek = errors.New("encrypted: invalid seek")
+
+// rangeWriter collects the body of a ServeFile response into a pipe.
+type rangeWriter struct {
+	header http.Header
+	status int
+	skip   int64
+	pw     *io.PipeWriter
+}
+
+func (w *rangeWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *rangeWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+
+	switch w.status {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the backend ignored the range, skip ahead to its start
+		if w.skip > 0 {
+			if int64(len(p)) <= w.skip {
+				w.skip -= int64(len(p))
+				return len(p), nil
+			}
+			n, err := w.pw.Write(p[w.skip:])
+			n += int(w.skip)
+			w.skip = 0
+			return n, err
+		}
+	default:
+		return 0, fmt.Errorf("encrypted: unexpected status %d reading a range", w.status)
+	}
+
+	return w.pw.Write(p)
+}
+
+// readRange returns bytes start to end of the stored file. StorageBackend
+// has no ranged reads of its own, so this goes through ServeFile, which all
+// backends implement with Range support.
+func readRange(inner backends.StorageBackend, key string, start, end int64) (io.ReadCloser, error) {
+	// the path is not used to find the file, and http.ServeFile treats
+	// some paths specially
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	pr, pw := io.Pipe()
+	w := &rangeWriter{header: make(http.Header), skip: start, pw: pw}
+	go func() {
+		err := inner.ServeFile(key, w, req)
+		if err == nil && w.status != http.StatusOK && w.status != http.StatusPartialContent {
+			err = fmt.Errorf("encrypted: unexpected status %d reading a range", w.status)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(pr, end-start+1), pr}, nil
+}
+
+// rangeReader decrypts any part of a file, reading only the chunks that
+// are needed. It is what ServeFile hands to http.ServeContent.
+type rangeReader struct {
+	inner  backends.StorageBackend
+	key    string
+	h      header
+	size   int64 // plaintext
+	stored int64 // ciphertext, including the header
+	chunks int64
+
+	mu     sync.Mutex
+	offset int64
+	body   io.ReadCloser // positioned at chunk next
+	next   int64
+	cached int64 // index of the chunk in buf, or -1
+	buf    []byte
+}
+
+func newRangeReader(inner backends.StorageBackend, key string, h header, stored int64) *rangeReader {
+	size, chunks := plainSize(stored, h)
+	return &rangeReader{
+		inner:  inner,
+		key:    key,
+		h:      h,
+		size:   size,
+		stored: stored,
+		chunks: chunks,
+		cached: -1,
+	}
+}
+
+// chunk returns the decrypted chunk n. The caller must hold r.mu.
+func (r *rangeReader) chunk(n int64) ([]byte, error) {
+	if n == r.cached {
+		return r.buf, nil
+	}
+
+	if r.body == nil || r.next != n {
+		if r.body != nil {
+			r.body.Close()
+		}
+
+		var err error
+		r.body, err = readRange(r.inner, r.key, r.h.len()+n*(chunkSize+overhead), r.stored-1)
+		if err != nil {
+			return nil, err
+		}
+		r.next = n
+	}
+
+	size := int64(chunkSize + overhead)
+	if n == r.chunks-1 {
+		size = r.stored - r.h.len() - n*(chunkSize+overhead)
+	}
+
+	sealed := make([]byte, size)
+	_, err := io.ReadFull(r.body, sealed)
+	if err != nil {
+		r.body.Close()
+		r.body = nil
+		return nil, err
+	}
+	r.next++
+
+	r.buf, err = r.h.aead.Open(sealed[:0], chunkNonce(n), sealed, chunkAAD(n == r.chunks-1))
+	if err != nil {
+		r.cached = -1
+		return nil, errCorrupt
+	}
+	r.cached = n
+	return r.buf, nil
+}
+
+func (r *rangeReader) readAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) && off < r.size {
+		var buf []byte
+		buf, err = r.chunk(off / chunkSize)
+		if err != nil {
+			return
+		}
+
+		copied := copy(p[n:], buf[off%chunkSize:])
+		n += copied
+		off += int64(copied)
+	}
+
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	n, err := r.readAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.readAt(p, off)
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errInvalidSeek
+	}
+	if offset < 0 {
+		return 0, errInvalidSeek
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *rangeReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// openRange reads the header of the file stored under key and returns a
+// rangeReader for its contents. Files stored before encryption was enabled
+// are reported with ok set to false.
+func (b EncryptedBackend) openRange(key string) (r *rangeReader, ok bool, err error) {
+	stored, err := b.inner.Size(key)
+	if err != nil {
+		return
+	}
+
+	end := stored - 1
+	if end >= int64(maxHeaderLen) {
+		end = int64(maxHeaderLen) - 1
+	}
+	body, err := readRange(b.inner, key, 0, end)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+
+	prefix, err := ioutil.ReadAll(body)
+	if err != nil {
+		return
+	}
+	if !isEncrypted(prefix) {
+		return nil, false, nil
+	}
+
+	h, err := b.keys.readHeader(bytes.NewReader(prefix), key)
+	if err != nil {
+		return
+	}
+	return newRangeReader(b.inner, key, h, stored), true, nil
+}
@@ -0,0 +1,355 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// key -> metadata
+	metaBucket = []byte("metadata")
+
+	// big-endian expiry timestamp followed by the key -> nothing, for
+	// files that expire, and files whose metadata can't be read
+	expiryBucket = []byte("expiry")
+)
+
+var errNoPresign = errors.New("index: the backend can't presign URLs")
+
+// Keys are read this many at a time, so that callbacks are not run inside
+// a transaction and can modify the index.
+const batchSize = 1000
+
+// IndexedBackend keeps a copy of the metadata of every file of another
+// backend in a bbolt database. Metadata lookups, listings and expiry scans
+// are answered from the database rather than the backend.
+type IndexedBackend struct {
+	inner backends.MetaStorageBackend
+	db    *bolt.DB
+}
+
+// NewIndexedBackend opens or creates the index database at path. Only one
+// process can have it open at a time.
+func NewIndexedBackend(inner backends.MetaStorageBackend, path string) (b IndexedBackend, err error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metaBucket, expiryBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return
+	}
+
+	return IndexedBackend{inner: inner, db: db}, nil
+}
+
+func (b IndexedBackend) Close() error {
+	return b.db.Close()
+}
+
+func expiryKey(expiry time.Time, key string) []byte {
+	// times before the epoch, such as that of missing metadata, are long
+	// past and sort first
+	ts := expiry.Unix()
+	if ts < 0 {
+		ts = 0
+	}
+
+	k := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(k, uint64(ts))
+	return append(k, key...)
+}
+
+// orphanKey lists a file without readable metadata as expired, so that
+// cleanup removes it as it does without the index.
+func orphanKey(key string) []byte {
+	return expiryKey(time.Time{}, key)
+}
+
+func putEntry(tx *bolt.Tx, key string, m backends.Metadata) error {
+	if err := deleteEntry(tx, key); err != nil {
+		return err
+	}
+
+	data, err := backends.MarshalMetadata(m)
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(metaBucket).Put([]byte(key), data); err != nil {
+		return err
+	}
+
+	if m.Expiry.Equal(expiry.NeverExpire) {
+		return nil
+	}
+	return tx.Bucket(expiryBucket).Put(expiryKey(m.Expiry, key), []byte{})
+}
+
+func deleteEntry(tx *bolt.Tx, key string) error {
+	if err := tx.Bucket(expiryBucket).Delete(orphanKey(key)); err != nil {
+		return err
+	}
+
+	meta := tx.Bucket(metaBucket)
+	m, err := getEntry(tx, key)
+	if err == backends.NotFoundErr {
+		return nil
+	} else if err == nil {
+		err = tx.Bucket(expiryBucket).Delete(expiryKey(m.Expiry, key))
+		if err != nil {
+			return err
+		}
+	}
+	return meta.Delete([]byte(key))
+}
+
+func getEntry(tx *bolt.Tx, key string) (m backends.Metadata, err error) {
+	data := tx.Bucket(metaBucket).Get([]byte(key))
+	if data == nil {
+		return m, backends.NotFoundErr
+	}
+
+	return backends.UnmarshalMetadata(data)
+}
+
+func (b IndexedBackend) index(key string, m backends.Metadata) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putEntry(tx, key, m)
+	})
+}
+
+// forget drops key from the index if the backend reported it missing.
+func (b IndexedBackend) forget(key string, err error) {
+	if err != backends.NotFoundErr {
+		return
+	}
+	b.db.Update(func(tx *bolt.Tx) error {
+		return deleteEntry(tx, key)
+	})
+}
+
+func (b IndexedBackend) Delete(key string) error {
+	err := b.inner.Delete(key)
+	ierr := b.db.Update(func(tx *bolt.Tx) error {
+		if err != nil && err != backends.NotFoundErr {
+			// files without metadata don't fully delete, only try once
+			return tx.Bucket(expiryBucket).Delete(orphanKey(key))
+		}
+		return deleteEntry(tx, key)
+	})
+	if err != nil && err != backends.NotFoundErr {
+		return err
+	}
+	if ierr != nil {
+		return ierr
+	}
+	return err
+}
+
+func (b IndexedBackend) Exists(key string) (bool, error) {
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(metaBucket).Get([]byte(key)) != nil
+		return nil
+	})
+	if err != nil || found {
+		return found, err
+	}
+	return b.inner.Exists(key)
+}
+
+// Head answers from the index. Files missing from it, such as files stored
+// before the index was built, are looked up in the backend and indexed.
+func (b IndexedBackend) Head(key string) (m backends.Metadata, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		m, err = getEntry(tx, key)
+		return err
+	})
+	if err != backends.NotFoundErr {
+		return
+	}
+
+	m, err = b.inner.Head(key)
+	if err != nil {
+		return
+	}
+	if ierr := b.index(key, m); ierr != nil {
+		log.Printf("Failed to index %s: %v", key, ierr)
+	}
+	return
+}
+
+func (b IndexedBackend) Get(key string) (backends.Metadata, io.ReadCloser, error) {
+	m, r, err := b.inner.Get(key)
+	b.forget(key, err)
+	return m, r, err
+}
+
+func (b IndexedBackend) Put(key string, r io.Reader, meta backends.Metadata) (m backends.Metadata, err error) {
+	m, err = b.inner.Put(key, r, meta)
+	if err != nil {
+		return
+	}
+	err = b.index(key, m)
+	return
+}
+
+func (b IndexedBackend) PutMetadata(key string, m backends.Metadata) error {
+	if err := b.inner.PutMetadata(key, m); err != nil {
+		return err
+	}
+	return b.index(key, m)
+}
+
+func (b IndexedBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) error {
+	err := b.inner.ServeFile(key, w, r)
+	b.forget(key, err)
+	return err
+}
+
+func (b IndexedBackend) Size(key string) (int64, error) {
+	return b.inner.Size(key)
+}
+
+// PresignURL hands out URLs from the backend, if it can.
+func (b IndexedBackend) PresignURL(key, mimetype string, d time.Duration) (string, error) {
+	p, ok := b.inner.(backends.PresignedStorageBackend)
+	if !ok {
+		return "", errNoPresign
+	}
+	return p.PresignURL(key, mimetype, d)
+}
+
+// scan calls fn for the keys of bucket, in order, up to but excluding
+// stop if it is not nil.
+func (b IndexedBackend) scan(bucket, stop []byte, fn func(k []byte) error) error {
+	var start []byte
+	for {
+		var batch [][]byte
+		err := b.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(bucket).Cursor()
+			k, _ := c.First()
+			if start != nil {
+				k, _ = c.Seek(start)
+			}
+			for ; k != nil && len(batch) < batchSize; k, _ = c.Next() {
+				if stop != nil && string(k) >= string(stop) {
+					break
+				}
+				batch = append(batch, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range batch {
+			if err = fn(k); err != nil {
+				return err
+			}
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+		start = append(batch[len(batch)-1], 0)
+	}
+}
+
+func (b IndexedBackend) List(fn func(key string) error) error {
+	return b.scan(metaBucket, nil, func(k []byte) error {
+		return fn(string(k))
+	})
+}
+
+// ListExpired calls fn for every file that expires before the given time,
+// without reading the metadata of other files.
+func (b IndexedBackend) ListExpired(before time.Time, fn func(key string) error) error {
+	return b.scan(expiryBucket, expiryKey(before, ""), func(k []byte) error {
+		return fn(string(k[8:]))
+	})
+}
+
+// Rebuild replaces the contents of the index with the metadata of every
+// file of the backend.
+func (b IndexedBackend) Rebuild(noLogs bool) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metaBucket, expiryBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	indexed := 0
+	keys := make([]string, 0, batchSize)
+	metadata := make([]backends.Metadata, 0, batchSize)
+	var orphans []string
+	flush := func() error {
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			for i, key := range keys {
+				if err := putEntry(tx, key, metadata[i]); err != nil {
+					return err
+				}
+			}
+			for _, key := range orphans {
+				if err := tx.Bucket(expiryBucket).Put(orphanKey(key), []byte{}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		indexed += len(keys)
+		keys, metadata, orphans = keys[:0], metadata[:0], orphans[:0]
+		return err
+	}
+
+	err = b.inner.List(func(key string) error {
+		m, err := b.inner.Head(key)
+		if err == backends.NotFoundErr || err == backends.BadMetadata {
+			orphans = append(orphans, key)
+		} else if err != nil {
+			log.Printf("Skipping %s, could not read its metadata: %v", key, err)
+			return nil
+		} else {
+			keys = append(keys, key)
+			metadata = append(metadata, m)
+		}
+
+		if len(keys)+len(orphans) < batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == nil && !noLogs {
+		log.Printf("Indexed %d files", indexed)
+	}
+	return err
+}
@@ -0,0 +1,212 @@
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/cleanup"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func newTestBackend(t *testing.T) (IndexedBackend, *memory.MemoryBackend, func()) {
+	dir, err := ioutil.TempDir("", "linx-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner := memory.NewMemoryBackend(0)
+	b, err := NewIndexedBackend(inner, path.Join(dir, "index.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return b, inner, func() {
+		b.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func listKeys(t *testing.T, list func(fn func(key string) error) error) []string {
+	var keys []string
+	err := list(func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestIndexFollowsChanges(t *testing.T) {
+	b, inner, done := newTestBackend(t)
+	defer done()
+
+	_, err := b.Put("test.txt", strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey", AccessKey: "acckey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deleting behind the index's back shows it answers lookups itself
+	inner.Delete("test.txt")
+	m, err := b.Head("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != 12 || m.DeleteKey != "delkey" || m.AccessKey != "acckey" {
+		t.Fatalf("Indexed metadata was %+v", m)
+	}
+
+	// the backend reporting the file missing removes it from the index
+	if _, _, err = b.Get("test.txt"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr, got %v", err)
+	}
+	if ok, _ := b.Exists("test.txt"); ok {
+		t.Fatal("Missing file is still indexed")
+	}
+
+	_, err = b.Put("test.txt", strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Mimetype = "text/x-go"
+	m.AccessKey = ""
+	m.MaxDownloads = 2
+	m.Downloads = 1
+	if err = b.PutMetadata("test.txt", m); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ = b.Head("test.txt"); m.Mimetype != "text/x-go" || m.MaxDownloads != 2 || m.Downloads != 1 {
+		t.Fatal("PutMetadata was not indexed")
+	}
+
+	if err = b.Delete("test.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Head("test.txt"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr after Delete, got %v", err)
+	}
+}
+
+func TestListExpired(t *testing.T) {
+	b, _, done := newTestBackend(t)
+	defer done()
+
+	now := time.Now()
+	for i, exp := range []time.Time{
+		expiry.NeverExpire,
+		now.Add(-time.Hour),
+		now.Add(-time.Minute),
+		now.Add(time.Hour),
+	} {
+		_, err := b.Put(fmt.Sprintf("file%d.txt", i), strings.NewReader("File content"), backends.Metadata{Expiry: exp, DeleteKey: "delkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// moving the expiry of a file forward takes it off the expired list
+	m, _ := b.Head("file2.txt")
+	m.Expiry = now.Add(2 * time.Hour)
+	if err := b.PutMetadata("file2.txt", m); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := listKeys(t, func(fn func(key string) error) error {
+		return b.ListExpired(now, fn)
+	})
+	if strings.Join(expired, ",") != "file1.txt" {
+		t.Fatalf("Expired files were %v", expired)
+	}
+
+	if keys := listKeys(t, b.List); len(keys) != 4 {
+		t.Fatalf("Listed %v", keys)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	b, inner, done := newTestBackend(t)
+	defer done()
+
+	_, err := b.Put("stale.txt", strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner.Delete("stale.txt")
+
+	// more than a batch, to check listing carries on where it left off
+	for i := 0; i < batchSize+10; i++ {
+		_, err := inner.Put(fmt.Sprintf("file%04d.txt", i), strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = b.Rebuild(true); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := listKeys(t, b.List)
+	if len(keys) != batchSize+10 || keys[0] != "file0000.txt" {
+		t.Fatalf("Listed %d files starting with %s", len(keys), keys[0])
+	}
+}
+
+func TestCleanupOrphans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linx-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := localfs.NewLocalfsBackend(path.Join(dir, "meta"), path.Join(dir, "files"))
+	for _, key := range []string{"orphan.txt", "zero.txt", "kept.txt"} {
+		_, err := inner.Put(key, strings.NewReader("File content"), backends.Metadata{Expiry: time.Now().Add(time.Hour), DeleteKey: "delkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(path.Join(dir, "meta", "orphan.txt"))
+	m, _ := inner.Head("zero.txt")
+	m.Expiry = time.Time{}
+	if err = inner.PutMetadata("zero.txt", m); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewIndexedBackend(inner, path.Join(dir, "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err = b.Rebuild(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// cleanup removes what it would without the index
+	if err = cleanup.Cleanup(b, true); err != nil {
+		t.Fatal(err)
+	}
+	for key, kept := range map[string]bool{"orphan.txt": false, "zero.txt": false, "kept.txt": true} {
+		if ok, _ := inner.Exists(key); ok != kept {
+			t.Fatalf("%s exists: %v", key, ok)
+		}
+	}
+
+	expired := listKeys(t, func(fn func(key string) error) error {
+		return b.ListExpired(time.Now(), fn)
+	})
+	if len(expired) != 0 {
+		t.Fatalf("Expired files were %v after cleanup", expired)
+	}
+}
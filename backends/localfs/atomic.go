@@ -0,0 +1,62 @@
+package localfs
+
+import (
+	"os"
+	"path"
+	"runtime"
+
+	"github.com/dchest/uniuri"
+)
+
+// Prefix of files that are still being written. Uploads never start with a
+// dot, so these are never mistaken for one.
+const tempPrefix = ".tmp-"
+
+// Create a new temporary file in dir
+func createTemp(dir string) (*os.File, error) {
+	for {
+		name := path.Join(dir, tempPrefix+uniuri.New())
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+}
+
+// Flush a temporary file to disk and move it to dst. Either the complete
+// file ends up at dst or dst is left untouched.
+func commitTemp(tmp *os.File, dst string) error {
+	err := tmp.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), dst)
+	if err != nil {
+		return err
+	}
+
+	syncDir(path.Dir(dst))
+	return nil
+}
+
+// Make a rename in dir durable. Directories can't be synced on every
+// platform, so this is best effort.
+func syncDir(dir string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,211 @@
+package localfs
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/helpers"
+	"github.com/dchest/uniuri"
+)
+
+var errDedupDisabled = errors.New("localfs: deduplication is not enabled")
+var errChecksumMismatch = errors.New("localfs: file contents do not match metadata")
+
+// Return the location of the blob for a sha256sum, or an empty string if
+// the checksum is not a valid hex-encoded sha256sum
+func (b LocalfsBackend) blobPath(sha256sum string) string {
+	if len(sha256sum) != 64 {
+		return ""
+	}
+	if _, err := hex.DecodeString(sha256sum); err != nil {
+		return ""
+	}
+
+	return path.Join(b.blobsPath, sha256sum[0:2], sha256sum[2:4], sha256sum)
+}
+
+func (b LocalfsBackend) putBlob(key string, r io.Reader, meta backends.Metadata) (m backends.Metadata, err error) {
+	tmp, err := createTemp(b.blobsPath)
+	if err != nil {
+		return
+	}
+	defer tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	// Compute the metadata while the file is being written
+	hasher := helpers.NewMetadataHasher()
+	bytes, err := io.Copy(io.MultiWriter(tmp, hasher), r)
+	if bytes == 0 {
+		return m, backends.FileEmptyError
+	} else if err != nil {
+		return m, err
+	}
+
+	m = hasher.Complete(meta)
+	tmp.Seek(0, 0)
+
+	m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, tmp)
+
+	b.blobsLock.Lock()
+	defer b.blobsLock.Unlock()
+
+	// Remember what the key pointed to so that the old blob can be released
+	// when an upload is overwritten
+	previous, previousErr := b.Head(key)
+
+	blobPath := b.blobPath(m.Sha256sum)
+	_, err = os.Stat(blobPath)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(path.Dir(blobPath), 0755)
+		if err != nil {
+			return
+		}
+		err = commitTemp(tmp, blobPath)
+	}
+	if err != nil {
+		return
+	}
+
+	err = b.linkBlob(blobPath, key)
+	if err != nil {
+		b.releaseBlob(m.Sha256sum)
+		return
+	}
+
+	err = b.writeMetadata(key, m)
+	if err != nil {
+		os.Remove(b.filePath(key))
+		b.releaseBlob(m.Sha256sum)
+		return
+	}
+
+	if previousErr == nil && previous.Sha256sum != m.Sha256sum {
+		b.releaseBlob(previous.Sha256sum)
+	}
+
+	return
+}
+
+// Point key at blobPath, atomically replacing whatever file was there
+func (b LocalfsBackend) linkBlob(blobPath string, key string) error {
+	filePath := b.filePath(key)
+
+	// Renaming a hard link over another link to the same inode is a no-op
+	// that leaves both names in place, so handle that case up front
+	if fi, err := os.Stat(filePath); err == nil {
+		if bi, err := os.Stat(blobPath); err == nil && os.SameFile(fi, bi) {
+			return nil
+		}
+	}
+
+	err := os.MkdirAll(path.Dir(filePath), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path.Join(path.Dir(filePath), tempPrefix+uniuri.New())
+	err = os.Link(blobPath, tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	syncDir(path.Dir(filePath))
+	return nil
+}
+
+// Remove the blob for sha256sum if no file refers to it anymore
+func (b LocalfsBackend) releaseBlob(sha256sum string) error {
+	blobPath := b.blobPath(sha256sum)
+	if blobPath == "" {
+		return nil
+	}
+
+	links, err := linkCount(blobPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if links <= 1 {
+		return os.Remove(blobPath)
+	}
+
+	return nil
+}
+
+// Deduplicate converts a file stored as a plain copy into a reference to
+// its content-addressed blob. It returns false if the file was already
+// backed by a blob.
+func (b LocalfsBackend) Deduplicate(key string) (converted bool, err error) {
+	if b.blobsPath == "" {
+		return false, errDedupDisabled
+	}
+
+	b.blobsLock.Lock()
+	defer b.blobsLock.Unlock()
+
+	metadata, err := b.Head(key)
+	if err != nil {
+		return
+	}
+
+	filePath := b.filePath(key)
+	blobPath := b.blobPath(metadata.Sha256sum)
+	if blobPath == "" {
+		return false, backends.BadMetadata
+	}
+
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+
+	bi, err := os.Stat(blobPath)
+	if err == nil && os.SameFile(fi, bi) {
+		return false, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	// Never trust the metadata blindly, a blob is shared by every file with
+	// the same checksum
+	f, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	actual, err := helpers.GenerateMetadata(f)
+	f.Close()
+	if err != nil {
+		return
+	}
+	if actual.Sha256sum != metadata.Sha256sum {
+		return false, errChecksumMismatch
+	}
+
+	if bi == nil {
+		err = os.MkdirAll(path.Dir(blobPath), 0755)
+		if err != nil {
+			return
+		}
+		err = os.Link(filePath, blobPath)
+		syncDir(path.Dir(blobPath))
+	} else {
+		err = b.linkBlob(blobPath, key)
+	}
+	if err != nil {
+		return
+	}
+
+	return true, nil
+}
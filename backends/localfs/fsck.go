@@ -0,0 +1,241 @@
+package localfs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/helpers"
+)
+
+type Problem int
+
+const (
+	// A file without metadata, usually an upload that never completed
+	OrphanedFile Problem = iota
+	// Metadata without a file
+	OrphanedMetadata
+	// Metadata that can't be decoded
+	CorruptMetadata
+	// A file whose size differs from its metadata
+	SizeMismatch
+	// A file whose sha256sum differs from its metadata
+	ChecksumMismatch
+	// A deduplicated blob that no file refers to
+	OrphanedBlob
+	// A temporary file left behind by an interrupted write
+	StaleTempFile
+)
+
+func (p Problem) String() string {
+	switch p {
+	case OrphanedFile:
+		return "orphaned file"
+	case OrphanedMetadata:
+		return "orphaned metadata"
+	case CorruptMetadata:
+		return "corrupt metadata"
+	case SizeMismatch:
+		return "size mismatch"
+	case ChecksumMismatch:
+		return "checksum mismatch"
+	case OrphanedBlob:
+		return "orphaned blob"
+	case StaleTempFile:
+		return "stale temporary file"
+	}
+	return "unknown problem"
+}
+
+type Issue struct {
+	Problem Problem
+	// Name of the upload, empty for blobs and temporary files
+	Key string
+	// Location on disk, only set for blobs and temporary files
+	Path string
+}
+
+// Temporary files younger than this may belong to a write in progress
+const staleTempAge = time.Hour
+
+var errCannotRepair = errors.New("localfs: can't be repaired, quarantine it instead")
+
+// Check looks for inconsistencies between files, metadata and blobs and
+// calls fn for every one it finds. Comparing checksums requires reading
+// every file and is only done if verifyChecksums is set.
+func (b LocalfsBackend) Check(verifyChecksums bool, fn func(Issue)) error {
+	staleBefore := time.Now().Add(-staleTempAge)
+
+	checkTemp := func(dir string, file os.FileInfo) bool {
+		if !strings.HasPrefix(file.Name(), ".") {
+			return false
+		}
+		if strings.HasPrefix(file.Name(), tempPrefix) && file.ModTime().Before(staleBefore) {
+			fn(Issue{Problem: StaleTempFile, Path: path.Join(dir, file.Name())})
+		}
+		return true
+	}
+
+	err := walkDir(b.filesPath, b.shardDepth, func(dir string, file os.FileInfo) error {
+		if checkTemp(dir, file) {
+			return nil
+		}
+
+		key := file.Name()
+		metadata, err := b.Head(key)
+		if err == backends.NotFoundErr {
+			fn(Issue{Problem: OrphanedFile, Key: key})
+			return nil
+		} else if err != nil {
+			fn(Issue{Problem: CorruptMetadata, Key: key})
+			return nil
+		}
+
+		if metadata.Encoding != "" || metadata.Encrypted {
+			// stored compressed or encrypted, the metadata describes the
+			// original
+			return nil
+		}
+
+		if metadata.Size != file.Size() {
+			fn(Issue{Problem: SizeMismatch, Key: key})
+		} else if verifyChecksums {
+			actual, err := b.generateMetadata(key)
+			if err != nil {
+				return err
+			}
+			if actual.Sha256sum != metadata.Sha256sum {
+				fn(Issue{Problem: ChecksumMismatch, Key: key})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = walkDir(b.metaPath, b.shardDepth, func(dir string, file os.FileInfo) error {
+		if checkTemp(dir, file) {
+			return nil
+		}
+
+		if _, err := os.Stat(b.filePath(file.Name())); os.IsNotExist(err) {
+			fn(Issue{Problem: OrphanedMetadata, Key: file.Name()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if b.blobsPath == "" {
+		return nil
+	}
+
+	err = walkDir(b.blobsPath, 0, func(dir string, file os.FileInfo) error {
+		checkTemp(dir, file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return walkDir(b.blobsPath, 2, func(dir string, file os.FileInfo) error {
+		if checkTemp(dir, file) {
+			return nil
+		}
+
+		blobPath := path.Join(dir, file.Name())
+		links, err := linkCount(blobPath)
+		if err != nil {
+			return err
+		}
+		if links <= 1 {
+			fn(Issue{Problem: OrphanedBlob, Path: blobPath})
+		}
+		return nil
+	})
+}
+
+// Read a stored file and compute the metadata that describes its contents
+func (b LocalfsBackend) generateMetadata(key string) (m backends.Metadata, err error) {
+	f, err := os.Open(b.filePath(key))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	m, err = helpers.GenerateMetadata(f)
+	if err != nil {
+		return
+	}
+
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return
+	}
+	m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, f)
+
+	return
+}
+
+// Repair resolves an issue found by Check. Files without metadata were
+// never handed out and are removed, as are leftover blobs and temporary
+// files. Files that don't match their metadata are damaged, and rebuilding
+// the metadata from them would make them look valid, while corrupt
+// metadata can't be rebuilt without losing its access key, so both have to
+// be quarantined.
+func (b LocalfsBackend) Repair(issue Issue) error {
+	switch issue.Problem {
+	case OrphanedFile:
+		return os.Remove(b.filePath(issue.Key))
+
+	case OrphanedMetadata:
+		return os.Remove(b.metaFilePath(issue.Key))
+
+	case OrphanedBlob, StaleTempFile:
+		return os.Remove(issue.Path)
+	}
+
+	return errCannotRepair
+}
+
+// Quarantine moves everything involved in an issue into dir, out of reach
+// of the server. Uploads end up in dir/files and dir/meta.
+func (b LocalfsBackend) Quarantine(issue Issue, dir string) error {
+	if issue.Key == "" {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+		return os.Rename(issue.Path, path.Join(dir, path.Base(issue.Path)))
+	}
+
+	moves := [][2]string{
+		{b.filePath(issue.Key), path.Join(dir, "files", issue.Key)},
+		{b.metaFilePath(issue.Key), path.Join(dir, "meta", issue.Key)},
+	}
+
+	for _, move := range moves {
+		from, to := move[0], move[1]
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			continue
+		}
+
+		err := os.MkdirAll(path.Dir(to), 0700)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(from, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
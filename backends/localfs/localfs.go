@@ -1,12 +1,12 @@
 package localfs
 
 import (
-	"encoding/json"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/andreimarcu/linx-server/backends"
@@ -14,36 +14,65 @@ import (
 )
 
 type LocalfsBackend struct {
-	metaPath  string
-	filesPath string
+	metaPath   string
+	filesPath  string
+	blobsPath  string
+	blobsLock  *sync.Mutex
+	shardDepth int
 }
 
-type MetadataJSON struct {
-	DeleteKey    string   `json:"delete_key"`
-	AccessKey    string   `json:"access_key,omitempty"`
-	Sha256sum    string   `json:"sha256sum"`
-	Mimetype     string   `json:"mimetype"`
-	Size         int64    `json:"size"`
-	Expiry       int64    `json:"expiry"`
-	ArchiveFiles []string `json:"archive_files,omitempty"`
+type LocalfsOptions struct {
+	// Directory holding content-addressed blobs. When set, every upload is
+	// stored once under its sha256sum and files in filesPath are hard links
+	// to that blob. Must be on the same filesystem as filesPath.
+	BlobsPath string
+
+	// Number of directory levels to spread files and metadata over, for
+	// example 2 stores "abcdxyz.png" as "3f/a2/abcdxyz.png". The directories
+	// are derived from a hash of the filename. 0 keeps everything in one
+	// directory.
+	ShardDepth int
 }
 
 func (b LocalfsBackend) Delete(key string) (err error) {
-	err = os.Remove(path.Join(b.filesPath, key))
+	if b.blobsPath == "" {
+		err = os.Remove(b.filePath(key))
+		if err != nil {
+			return
+		}
+		err = os.Remove(b.metaFilePath(key))
+		return
+	}
+
+	b.blobsLock.Lock()
+	defer b.blobsLock.Unlock()
+
+	// The metadata is the only place that tells us which blob the file
+	// refers to, so read it before anything is removed.
+	metadata, _ := b.Head(key)
+
+	err = os.Remove(b.filePath(key))
 	if err != nil {
 		return
 	}
-	err = os.Remove(path.Join(b.metaPath, key))
+	err = os.Remove(b.metaFilePath(key))
+	if err != nil {
+		return
+	}
+
+	if metadata.Sha256sum != "" {
+		err = b.releaseBlob(metadata.Sha256sum)
+	}
 	return
 }
 
 func (b LocalfsBackend) Exists(key string) (bool, error) {
-	_, err := os.Stat(path.Join(b.filesPath, key))
+	_, err := os.Stat(b.filePath(key))
 	return err == nil, err
 }
 
 func (b LocalfsBackend) Head(key string) (metadata backends.Metadata, err error) {
-	f, err := os.Open(path.Join(b.metaPath, key))
+	f, err := os.Open(b.metaFilePath(key))
 	if os.IsNotExist(err) {
 		return metadata, backends.NotFoundErr
 	} else if err != nil {
@@ -51,22 +80,12 @@ func (b LocalfsBackend) Head(key string) (metadata backends.Metadata, err error)
 	}
 	defer f.Close()
 
-	decoder := json.NewDecoder(f)
-
-	mjson := MetadataJSON{}
-	if err := decoder.Decode(&mjson); err != nil {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
 		return metadata, backends.BadMetadata
 	}
 
-	metadata.DeleteKey = mjson.DeleteKey
-	metadata.AccessKey = mjson.AccessKey
-	metadata.Mimetype = mjson.Mimetype
-	metadata.ArchiveFiles = mjson.ArchiveFiles
-	metadata.Sha256sum = mjson.Sha256sum
-	metadata.Expiry = time.Unix(mjson.Expiry, 0)
-	metadata.Size = mjson.Size
-
-	return
+	return backends.UnmarshalMetadata(data)
 }
 
 func (b LocalfsBackend) Get(key string) (metadata backends.Metadata, f io.ReadCloser, err error) {
@@ -75,7 +94,7 @@ func (b LocalfsBackend) Get(key string) (metadata backends.Metadata, f io.ReadCl
 		return
 	}
 
-	f, err = os.Open(path.Join(b.filesPath, key))
+	f, err = os.Open(b.filePath(key))
 	if err != nil {
 		return
 	}
@@ -89,71 +108,80 @@ func (b LocalfsBackend) ServeFile(key string, w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	filePath := path.Join(b.filesPath, key)
+	filePath := b.filePath(key)
 	http.ServeFile(w, r, filePath)
 
 	return
 }
 
 func (b LocalfsBackend) writeMetadata(key string, metadata backends.Metadata) error {
-	metaPath := path.Join(b.metaPath, key)
+	metaPath := b.metaFilePath(key)
 
-	mjson := MetadataJSON{
-		DeleteKey:    metadata.DeleteKey,
-		AccessKey:    metadata.AccessKey,
-		Mimetype:     metadata.Mimetype,
-		ArchiveFiles: metadata.ArchiveFiles,
-		Sha256sum:    metadata.Sha256sum,
-		Expiry:       metadata.Expiry.Unix(),
-		Size:         metadata.Size,
+	data, err := backends.MarshalMetadata(metadata)
+	if err != nil {
+		return err
 	}
 
-	dst, err := os.Create(metaPath)
+	err = os.MkdirAll(path.Dir(metaPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	dst, err := createTemp(path.Dir(metaPath))
 	if err != nil {
 		return err
 	}
 	defer dst.Close()
+	defer os.Remove(dst.Name())
 
-	encoder := json.NewEncoder(dst)
-	err = encoder.Encode(mjson)
+	_, err = dst.Write(append(data, '\n'))
 	if err != nil {
-		os.Remove(metaPath)
 		return err
 	}
 
-	return nil
+	return commitTemp(dst, metaPath)
 }
 
-func (b LocalfsBackend) Put(key string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (m backends.Metadata, err error) {
-	filePath := path.Join(b.filesPath, key)
+func (b LocalfsBackend) Put(key string, r io.Reader, meta backends.Metadata) (m backends.Metadata, err error) {
+	if b.blobsPath != "" {
+		return b.putBlob(key, r, meta)
+	}
+
+	filePath := b.filePath(key)
 
-	dst, err := os.Create(filePath)
+	err = os.MkdirAll(path.Dir(filePath), 0755)
+	if err != nil {
+		return
+	}
+
+	dst, err := createTemp(path.Dir(filePath))
 	if err != nil {
 		return
 	}
 	defer dst.Close()
+	defer os.Remove(dst.Name())
 
-	bytes, err := io.Copy(dst, r)
+	// Compute the metadata while the file is being written
+	hasher := helpers.NewMetadataHasher()
+	bytes, err := io.Copy(io.MultiWriter(dst, hasher), r)
 	if bytes == 0 {
-		os.Remove(filePath)
 		return m, backends.FileEmptyError
 	} else if err != nil {
-		os.Remove(filePath)
 		return m, err
 	}
 
+	m = hasher.Complete(meta)
 	dst.Seek(0, 0)
-	m, err = helpers.GenerateMetadata(dst)
+
+	m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, dst)
+
+	// The file is only moved into place once it is complete, and the
+	// metadata is written last so that a crash in between leaves an
+	// unreachable file rather than a truncated one
+	err = commitTemp(dst, filePath)
 	if err != nil {
-		os.Remove(filePath)
 		return
 	}
-	dst.Seek(0, 0)
-
-	m.Expiry = expiry
-	m.DeleteKey = deleteKey
-	m.AccessKey = accessKey
-	m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, dst)
 
 	err = b.writeMetadata(key, m)
 	if err != nil {
@@ -174,7 +202,7 @@ func (b LocalfsBackend) PutMetadata(key string, m backends.Metadata) (err error)
 }
 
 func (b LocalfsBackend) Size(key string) (int64, error) {
-	fileInfo, err := os.Stat(path.Join(b.filesPath, key))
+	fileInfo, err := os.Stat(b.filePath(key))
 	if err != nil {
 		return 0, err
 	}
@@ -182,24 +210,28 @@ func (b LocalfsBackend) Size(key string) (int64, error) {
 	return fileInfo.Size(), nil
 }
 
-func (b LocalfsBackend) List() ([]string, error) {
-	var output []string
-
-	files, err := ioutil.ReadDir(b.filesPath)
-	if err != nil {
-		return nil, err
-	}
-
-	for _, file := range files {
-		output = append(output, file.Name())
+// ModTime returns when the file stored under key was last written.
+func (b LocalfsBackend) ModTime(key string) (time.Time, error) {
+	fileInfo, err := os.Stat(b.filePath(key))
+	if os.IsNotExist(err) {
+		return time.Time{}, backends.NotFoundErr
+	} else if err != nil {
+		return time.Time{}, err
 	}
 
-	return output, nil
+	return fileInfo.ModTime(), nil
 }
 
 func NewLocalfsBackend(metaPath string, filesPath string) LocalfsBackend {
+	return NewLocalfsBackendWithOptions(metaPath, filesPath, LocalfsOptions{})
+}
+
+func NewLocalfsBackendWithOptions(metaPath string, filesPath string, o LocalfsOptions) LocalfsBackend {
 	return LocalfsBackend{
-		metaPath:  metaPath,
-		filesPath: filesPath,
+		metaPath:   metaPath,
+		filesPath:  filesPath,
+		blobsPath:  o.BlobsPath,
+		blobsLock:  &sync.Mutex{},
+		shardDepth: o.ShardDepth,
 	}
 }
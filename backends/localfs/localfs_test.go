@@ -0,0 +1,325 @@
+package localfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func newTestBackend(t *testing.T, o LocalfsOptions) (LocalfsBackend, func()) {
+	dir, err := ioutil.TempDir("", "linx-localfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filesPath := path.Join(dir, "files")
+	metaPath := path.Join(dir, "meta")
+	for _, p := range []string{filesPath, metaPath} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if o.BlobsPath != "" {
+		o.BlobsPath = path.Join(dir, o.BlobsPath)
+		if err := os.MkdirAll(o.BlobsPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return NewLocalfsBackendWithOptions(metaPath, filesPath, o), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func listKeys(t *testing.T, b LocalfsBackend) []string {
+	var keys []string
+	err := b.List(func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(ai, bi)
+}
+
+func TestPutKeepsGivenMetadata(t *testing.T) {
+	b, done := newTestBackend(t, LocalfsOptions{})
+	defer done()
+
+	_, err := b.Put("a.txt", strings.NewReader("File content"), backends.Metadata{
+		Expiry:       expiry.NeverExpire,
+		DeleteKey:    "key",
+		MaxDownloads: 3,
+		Mimetype:     "application/x-linx-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := b.Head("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MaxDownloads != 3 || m.DeleteKey != "key" {
+		t.Fatalf("Metadata given to Put was not stored: %+v", m)
+	}
+	if m.Mimetype != "application/x-linx-test" {
+		t.Fatalf("Given mimetype was replaced by %s", m.Mimetype)
+	}
+	if m.Size != 12 || m.Sha256sum == "" {
+		t.Fatalf("Size and checksum were not computed: %+v", m)
+	}
+}
+
+func TestDedupPutAndDelete(t *testing.T) {
+	b, done := newTestBackend(t, LocalfsOptions{BlobsPath: "blobs"})
+	defer done()
+
+	m1, err := b.Put("a.txt", strings.NewReader("Same content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Put("b.txt", strings.NewReader("Same content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "key2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := b.blobPath(m1.Sha256sum)
+	if !sameFile(t, blob, b.filePath("a.txt")) || !sameFile(t, blob, b.filePath("b.txt")) {
+		t.Fatal("Uploads with identical content do not share a blob")
+	}
+
+	_, r, err := b.Get("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(contents) != "Same content" {
+		t.Fatalf("Contents were %q", contents)
+	}
+
+	if err := b.Delete("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(blob); err != nil {
+		t.Fatal("Blob was removed while still referenced")
+	}
+
+	if err := b.Delete("b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Fatal("Blob was not removed after its last reference was deleted")
+	}
+}
+
+func TestDedupOverwrite(t *testing.T) {
+	b, done := newTestBackend(t, LocalfsOptions{BlobsPath: "blobs"})
+	defer done()
+
+	m1, err := b.Put("a.txt", strings.NewReader("Old content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Put("a.txt", strings.NewReader("New content"), backends.Metadata{Expiry: time.Now().Add(time.Hour), DeleteKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(b.blobPath(m1.Sha256sum)); !os.IsNotExist(err) {
+		t.Fatal("Blob of overwritten upload was not removed")
+	}
+
+	files := listKeys(t, b)
+	if len(files) != 1 || files[0] != "a.txt" {
+		t.Fatalf("Unexpected files listed: %v", files)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	flat, done := newTestBackend(t, LocalfsOptions{})
+	defer done()
+
+	for _, key := range []string{"a.txt", "b.txt"} {
+		_, err := flat.Put(key, strings.NewReader("Same content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "key"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blobsPath := path.Join(path.Dir(flat.filesPath), "blobs")
+	b := NewLocalfsBackendWithOptions(flat.metaPath, flat.filesPath, LocalfsOptions{BlobsPath: blobsPath})
+
+	for _, key := range []string{"a.txt", "b.txt"} {
+		converted, err := b.Deduplicate(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !converted {
+			t.Fatalf("%s was not converted", key)
+		}
+	}
+
+	converted, err := b.Deduplicate("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted {
+		t.Fatal("a.txt was converted twice")
+	}
+
+	if !sameFile(t, b.filePath("a.txt"), b.filePath("b.txt")) {
+		t.Fatal("Converted files do not share a blob")
+	}
+}
+
+func TestShardedPutAndList(t *testing.T) {
+	b, done := newTestBackend(t, LocalfsOptions{ShardDepth: 2})
+	defer done()
+
+	keys := []string{"a.txt", "b.txt", "c.txt"}
+	for _, key := range keys {
+		_, err := b.Put(key, strings.NewReader("File content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "key"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(b.filesPath, "a.txt")); !os.IsNotExist(err) {
+		t.Fatal("File was stored in the top level directory")
+	}
+
+	files := listKeys(t, b)
+	sort.Strings(files)
+	if strings.Join(files, ",") != strings.Join(keys, ",") {
+		t.Fatalf("Listed %v instead of %v", files, keys)
+	}
+
+	if _, err := b.Head("b.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	flat, done := newTestBackend(t, LocalfsOptions{})
+	defer done()
+
+	_, err := flat.Put("a.txt", strings.NewReader("File content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharded := NewLocalfsBackendWithOptions(flat.metaPath, flat.filesPath, LocalfsOptions{ShardDepth: 2})
+	if err := sharded.Relocate("a.txt", flat); err != nil {
+		t.Fatal(err)
+	}
+	// a second run must be harmless
+	if err := sharded.Relocate("a.txt", flat); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sharded.Head("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := flat.Exists("a.txt"); exists {
+		t.Fatal("File still exists in the flat layout")
+	}
+}
+
+func TestCheckAndRepair(t *testing.T) {
+	b, done := newTestBackend(t, LocalfsOptions{})
+	defer done()
+
+	for _, key := range []string{"ok.txt", "nometa.txt", "nofile.txt", "truncated.txt", "corrupt.txt"} {
+		_, err := b.Put(key, strings.NewReader("File content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "key"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	os.Remove(b.metaFilePath("nometa.txt"))
+	os.Remove(b.filePath("nofile.txt"))
+	os.Truncate(b.filePath("truncated.txt"), 4)
+	ioutil.WriteFile(b.metaFilePath("corrupt.txt"), []byte("{"), 0600)
+
+	expected := map[string]Problem{
+		"nometa.txt":    OrphanedFile,
+		"nofile.txt":    OrphanedMetadata,
+		"truncated.txt": SizeMismatch,
+		"corrupt.txt":   CorruptMetadata,
+	}
+
+	var issues []Issue
+	err := b.Check(true, func(issue Issue) {
+		issues = append(issues, issue)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(issues) != len(expected) {
+		t.Fatalf("Found %d issues instead of %d: %v", len(issues), len(expected), issues)
+	}
+	for _, issue := range issues {
+		if expected[issue.Key] != issue.Problem {
+			t.Fatalf("%s: found %s instead of %s", issue.Key, issue.Problem, expected[issue.Key])
+		}
+
+		err := b.Repair(issue)
+		if issue.Problem == CorruptMetadata || issue.Problem == SizeMismatch {
+			if err == nil {
+				t.Fatalf("%s: %s was repaired", issue.Key, issue.Problem)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// damaged files must not be made to look valid
+	m, err := b.Head("truncated.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != 12 {
+		t.Fatalf("Metadata was rewritten to match a damaged file: %+v", m)
+	}
+
+	quarantine := path.Join(path.Dir(b.filesPath), "quarantine")
+	for _, key := range []string{"corrupt.txt", "truncated.txt"} {
+		if err := b.Quarantine(Issue{Problem: expected[key], Key: key}, quarantine); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path.Join(quarantine, "files", key)); err != nil {
+			t.Fatalf("%s was not quarantined", key)
+		}
+	}
+
+	issues = nil
+	b.Check(true, func(issue Issue) {
+		issues = append(issues, issue)
+	})
+	if len(issues) != 0 {
+		t.Fatalf("Issues remain after repair: %v", issues)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package localfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Return the number of hard links pointing to the file at filePath
+func linkCount(filePath string) (uint64, error) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errors.New("localfs: link count not available")
+	}
+
+	return uint64(stat.Nlink), nil
+}
@@ -0,0 +1,23 @@
+package localfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// Return the number of hard links pointing to the file at filePath
+func linkCount(filePath string) (uint64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var info syscall.ByHandleFileInformation
+	err = syscall.GetFileInformationByHandle(syscall.Handle(f.Fd()), &info)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(info.NumberOfLinks), nil
+}
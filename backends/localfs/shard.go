@@ -0,0 +1,125 @@
+package localfs
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/sha256-simd"
+)
+
+const MaxShardDepth = 4
+
+// Return the directory, relative to the files or metadata directory, that
+// holds key
+func (b LocalfsBackend) shardDir(key string) string {
+	if b.shardDepth <= 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	digest := hex.EncodeToString(sum[:])
+
+	parts := make([]string, b.shardDepth)
+	for i := range parts {
+		parts[i] = digest[i*2 : i*2+2]
+	}
+
+	return path.Join(parts...)
+}
+
+func (b LocalfsBackend) filePath(key string) string {
+	return path.Join(b.filesPath, b.shardDir(key), key)
+}
+
+func (b LocalfsBackend) metaFilePath(key string) string {
+	return path.Join(b.metaPath, b.shardDir(key), key)
+}
+
+func (b LocalfsBackend) List(fn func(key string) error) error {
+	return walkDir(b.filesPath, b.shardDepth, func(dir string, file os.FileInfo) error {
+		// Skip in-progress writes
+		if strings.HasPrefix(file.Name(), ".") {
+			return nil
+		}
+		return fn(file.Name())
+	})
+}
+
+// Number of directory entries read at a time
+const readDirBatch = 1000
+
+// Call fn for every file found depth directory levels below dir. Entries
+// are read in batches, so directories of any size can be walked without
+// holding them in memory.
+func walkDir(dir string, depth int, fn func(dir string, file os.FileInfo) error) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	for {
+		files, err := d.Readdir(readDirBatch)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if depth > 0 {
+				if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+					err = walkDir(path.Join(dir, file.Name()), depth-1, fn)
+				}
+			} else if !file.IsDir() {
+				err = fn(dir, file)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Relocate moves the file and metadata for key from the layout used by src
+// into the layout used by b. Both backends must share the same filesystem.
+// Keys that are already in place are left alone.
+func (b LocalfsBackend) Relocate(key string, src LocalfsBackend) error {
+	moves := [][2]string{
+		{src.filePath(key), b.filePath(key)},
+		{src.metaFilePath(key), b.metaFilePath(key)},
+	}
+
+	for i, move := range moves {
+		from, to := move[0], move[1]
+		if from == to {
+			continue
+		}
+
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			// Already moved by an earlier, interrupted run
+			if _, err := os.Stat(to); err == nil {
+				continue
+			}
+		}
+
+		perm := os.FileMode(0755)
+		if i == 1 {
+			perm = 0700
+		}
+		err := os.MkdirAll(path.Dir(to), perm)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(from, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,258 @@
+package memory
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/andreimarcu/linx-server/helpers"
+)
+
+var FullErr = errors.New("Memory storage is full")
+
+type item struct {
+	key      string
+	data     []byte
+	metadata backends.Metadata
+	modtime  time.Time
+}
+
+// MemoryBackend keeps files and metadata in memory, for instances whose
+// uploads don't need to outlive the process. Stored data is limited to
+// maxSize bytes; when it is reached, expired files are evicted least
+// recently used first, and uploads fail if that doesn't free enough space.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	items   map[string]*list.Element
+	lru     *list.List // most recently used at the front
+	size    int64
+	maxSize int64
+}
+
+// NewMemoryBackend returns an empty MemoryBackend holding at most maxSize
+// bytes of file data, or an unlimited amount if maxSize is 0.
+func NewMemoryBackend(maxSize int64) *MemoryBackend {
+	return &MemoryBackend{
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+		maxSize: maxSize,
+	}
+}
+
+// get returns the item stored for key, marking it as used if touch is set.
+// The caller must hold b.mu.
+func (b *MemoryBackend) get(key string, touch bool) (*item, error) {
+	e, ok := b.items[key]
+	if !ok {
+		return nil, backends.NotFoundErr
+	}
+	if touch {
+		b.lru.MoveToFront(e)
+	}
+	return e.Value.(*item), nil
+}
+
+// remove drops the item stored in e. The caller must hold b.mu.
+func (b *MemoryBackend) remove(e *list.Element) {
+	it := b.lru.Remove(e).(*item)
+	delete(b.items, it.key)
+	b.size -= int64(len(it.data))
+}
+
+// makeRoom evicts expired items, least recently used first, until n more
+// bytes fit in place of the item stored under key, if any. That item is
+// left alone so that it is kept if there isn't enough room. The caller
+// must hold b.mu.
+func (b *MemoryBackend) makeRoom(n int64, key string) error {
+	if b.maxSize == 0 {
+		return nil
+	}
+
+	if e, ok := b.items[key]; ok {
+		n -= int64(len(e.Value.(*item).data))
+	}
+
+	for e := b.lru.Back(); e != nil && b.size+n > b.maxSize; {
+		prev := e.Prev()
+		if it := e.Value.(*item); it.key != key && expiry.IsTsExpired(it.metadata.Expiry) {
+			b.remove(e)
+		}
+		e = prev
+	}
+
+	if b.size+n > b.maxSize {
+		return FullErr
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.items[key]
+	if !ok {
+		return backends.NotFoundErr
+	}
+	b.remove(e)
+	return nil
+}
+
+func (b *MemoryBackend) Exists(key string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.items[key]
+	return ok, nil
+}
+
+func (b *MemoryBackend) Head(key string) (metadata backends.Metadata, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	it, err := b.get(key, false)
+	if err != nil {
+		return
+	}
+	return it.metadata, nil
+}
+
+func (b *MemoryBackend) Get(key string) (metadata backends.Metadata, r io.ReadCloser, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	it, err := b.get(key, true)
+	if err != nil {
+		return
+	}
+
+	// Stored data is never modified in place, so it can be read after
+	// the lock is released
+	return it.metadata, ioutil.NopCloser(bytes.NewReader(it.data)), nil
+}
+
+func (b *MemoryBackend) Put(key string, r io.Reader, meta backends.Metadata) (m backends.Metadata, err error) {
+	src := r
+	if b.maxSize > 0 {
+		src = io.LimitReader(r, b.maxSize+1)
+	}
+
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return
+	}
+	if int64(len(data)) > b.maxSize && b.maxSize > 0 {
+		return m, FullErr
+	}
+
+	if len(data) == 0 {
+		return m, backends.FileEmptyError
+	}
+
+	hasher := helpers.NewMetadataHasher()
+	hasher.Write(data)
+	m = hasher.Complete(meta)
+	m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, bytes.NewReader(data))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err = b.makeRoom(m.Size, key)
+	if err != nil {
+		return
+	}
+
+	if e, ok := b.items[key]; ok {
+		b.remove(e)
+	}
+
+	b.items[key] = b.lru.PushFront(&item{
+		key:      key,
+		data:     data,
+		metadata: m,
+		modtime:  time.Now(),
+	})
+	b.size += m.Size
+
+	return
+}
+
+func (b *MemoryBackend) PutMetadata(key string, m backends.Metadata) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	it, err := b.get(key, false)
+	if err != nil {
+		return err
+	}
+	it.metadata = m
+	return nil
+}
+
+func (b *MemoryBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) error {
+	b.mu.Lock()
+	it, err := b.get(key, true)
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	http.ServeContent(w, r, key, it.modtime, bytes.NewReader(it.data))
+	return nil
+}
+
+func (b *MemoryBackend) Size(key string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	it, err := b.get(key, false)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(it.data)), nil
+}
+
+// ModTime returns when the file stored under key was uploaded.
+func (b *MemoryBackend) ModTime(key string) (time.Time, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	it, err := b.get(key, false)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return it.modtime, nil
+}
+
+func (b *MemoryBackend) List(fn func(key string) error) error {
+	b.mu.Lock()
+	keys := make([]string, 0, len(b.items))
+	for key := range b.items {
+		keys = append(keys, key)
+	}
+	b.mu.Unlock()
+
+	// fn is called without holding the lock, so that it can modify the
+	// backend, e.g. to delete expired files
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Used returns the number of bytes of file data currently stored.
+func (b *MemoryBackend) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.size
+}
@@ -0,0 +1,158 @@
+package memory
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+func readAll(t *testing.T, b *MemoryBackend, key string) string {
+	_, r, err := b.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPutAndGet(t *testing.T) {
+	b := NewMemoryBackend(0)
+
+	m, err := b.Put("test.txt", strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey", AccessKey: "acckey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != 12 || m.Sha256sum != "f0ca7ef61aed3763f9bec72e14379549179c5d31cc25f23a6e62fcdc43f3374c" {
+		t.Fatalf("Wrong metadata %+v", m)
+	}
+
+	m, r, err := b.Get("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "File content" || m.DeleteKey != "delkey" || m.AccessKey != "acckey" {
+		t.Fatalf("Got %q with metadata %+v", data, m)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/selif/test.txt", nil)
+	req.Header.Set("Range", "bytes=5-")
+	err = b.ServeFile("test.txt", w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 206 || w.Body.String() != "content" {
+		t.Fatalf("Range request returned %d %q", w.Code, w.Body.String())
+	}
+
+	err = b.Delete("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Head("test.txt"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr after delete, got %v", err)
+	}
+	if b.Used() != 0 {
+		t.Fatalf("%d bytes still used after delete", b.Used())
+	}
+}
+
+func TestPutEmpty(t *testing.T) {
+	b := NewMemoryBackend(0)
+
+	_, err := b.Put("empty.txt", strings.NewReader(""), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != backends.FileEmptyError {
+		t.Fatalf("Expected FileEmptyError, got %v", err)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	b := NewMemoryBackend(10)
+	past := time.Now().Add(-time.Minute)
+
+	for _, key := range []string{"a", "b"} {
+		_, err := b.Put(key, strings.NewReader("1234"), backends.Metadata{Expiry: past, DeleteKey: "delkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := b.Put("live", strings.NewReader("12"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a is the least recently used expired file, so it goes first
+	_, r, err := b.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	_, err = b.Put("c", strings.NewReader("1234"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := b.Exists("b"); ok {
+		t.Fatal("Least recently used expired file was not evicted")
+	}
+	if ok, _ := b.Exists("a"); !ok {
+		t.Fatal("Recently used file was evicted")
+	}
+
+	// live files are never evicted
+	_, err = b.Put("d", strings.NewReader("123456"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != FullErr {
+		t.Fatalf("Expected FullErr, got %v", err)
+	}
+	if ok, _ := b.Exists("live"); !ok {
+		t.Fatal("Unexpired file was evicted")
+	}
+	if b.Used() != 6 {
+		t.Fatalf("Expected 6 bytes used, got %d", b.Used())
+	}
+
+	_, err = b.Put("huge", strings.NewReader("12345678901"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != FullErr {
+		t.Fatalf("Expected FullErr for a file larger than the cap, got %v", err)
+	}
+}
+
+func TestOverwriteWhenFull(t *testing.T) {
+	b := NewMemoryBackend(10)
+
+	for key, content := range map[string]string{"a": "123456", "b": "1234"} {
+		_, err := b.Put(key, strings.NewReader(content), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the old contents are kept when the new ones don't fit
+	_, err := b.Put("a", strings.NewReader("1234567"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != FullErr {
+		t.Fatalf("Expected FullErr, got %v", err)
+	}
+	if readAll(t, b, "a") != "123456" {
+		t.Fatal("File was lost when it could not be overwritten")
+	}
+
+	// and count as freed when they do
+	_, err = b.Put("a", strings.NewReader("abcdef"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readAll(t, b, "a") != "abcdef" || b.Used() != 10 {
+		t.Fatalf("File was not overwritten, %d bytes used", b.Used())
+	}
+}
@@ -13,6 +13,25 @@ type Metadata struct {
 	Size         int64
 	Expiry       time.Time
 	ArchiveFiles []string
+
+	// Encoding is the content coding the file is stored with, such as
+	// "gzip", or empty if it is stored as uploaded. Size and Sha256sum
+	// always describe the file as uploaded.
+	Encoding string
+
+	// Encrypted is set when the file and its metadata are stored
+	// encrypted, so that Size and Sha256sum only hold once decrypted.
+	Encrypted bool
+
+	// MaxDownloads is how many times the file can be downloaded before it
+	// is deleted, or 0 if there is no limit. Downloads counts them.
+	MaxDownloads int64
+	Downloads    int64
+
+	// Deadline is the expiry the file was uploaded with when its Expiry
+	// is pushed back as it is accessed, which it never goes past. It is
+	// zero for files whose expiry is fixed.
+	Deadline time.Time
 }
 
 var BadMetadata = errors.New("Corrupted metadata.")
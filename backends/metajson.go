@@ -0,0 +1,69 @@
+package backends
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// metadataJSON is how metadata is stored by the localfs backend and the
+// index, which share the same format.
+type metadataJSON struct {
+	DeleteKey    string   `json:"delete_key"`
+	AccessKey    string   `json:"access_key,omitempty"`
+	Sha256sum    string   `json:"sha256sum"`
+	Mimetype     string   `json:"mimetype"`
+	Size         int64    `json:"size"`
+	Expiry       int64    `json:"expiry"`
+	ArchiveFiles []string `json:"archive_files,omitempty"`
+	Encoding     string   `json:"encoding,omitempty"`
+	Encrypted    bool     `json:"encrypted,omitempty"`
+	MaxDownloads int64    `json:"max_downloads,omitempty"`
+	Downloads    int64    `json:"downloads,omitempty"`
+	Deadline     int64    `json:"deadline,omitempty"`
+}
+
+// MarshalMetadata encodes metadata as JSON.
+func MarshalMetadata(m Metadata) ([]byte, error) {
+	mjson := metadataJSON{
+		DeleteKey:    m.DeleteKey,
+		AccessKey:    m.AccessKey,
+		Sha256sum:    m.Sha256sum,
+		Mimetype:     m.Mimetype,
+		Size:         m.Size,
+		Expiry:       m.Expiry.Unix(),
+		ArchiveFiles: m.ArchiveFiles,
+		Encoding:     m.Encoding,
+		Encrypted:    m.Encrypted,
+		MaxDownloads: m.MaxDownloads,
+		Downloads:    m.Downloads,
+	}
+	if !m.Deadline.IsZero() {
+		mjson.Deadline = m.Deadline.Unix()
+	}
+	return json.Marshal(mjson)
+}
+
+// UnmarshalMetadata decodes metadata encoded by MarshalMetadata, failing
+// with BadMetadata if it can't be read.
+func UnmarshalMetadata(data []byte) (m Metadata, err error) {
+	var mjson metadataJSON
+	if err = json.Unmarshal(data, &mjson); err != nil {
+		return m, BadMetadata
+	}
+
+	m.DeleteKey = mjson.DeleteKey
+	m.AccessKey = mjson.AccessKey
+	m.Sha256sum = mjson.Sha256sum
+	m.Mimetype = mjson.Mimetype
+	m.Size = mjson.Size
+	m.Expiry = time.Unix(mjson.Expiry, 0)
+	m.ArchiveFiles = mjson.ArchiveFiles
+	m.Encoding = mjson.Encoding
+	m.Encrypted = mjson.Encrypted
+	m.MaxDownloads = mjson.MaxDownloads
+	m.Downloads = mjson.Downloads
+	if mjson.Deadline != 0 {
+		m.Deadline = time.Unix(mjson.Deadline, 0)
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package backends
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetadataJSONRoundTrip(t *testing.T) {
+	m := Metadata{
+		DeleteKey:    "delkey",
+		AccessKey:    "acckey",
+		Sha256sum:    "abc",
+		Mimetype:     "application/zip",
+		Size:         12,
+		Expiry:       time.Unix(1600000000, 0),
+		ArchiveFiles: []string{"a.txt", "b.txt"},
+		Encoding:     "gzip",
+		Encrypted:    true,
+		MaxDownloads: 3,
+		Downloads:    1,
+		Deadline:     time.Unix(1600003600, 0),
+	}
+
+	data, err := MarshalMetadata(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, m) {
+		t.Fatalf("Metadata changed from %+v to %+v", m, decoded)
+	}
+
+	if _, err := UnmarshalMetadata([]byte("{")); err != BadMetadata {
+		t.Fatalf("Broken metadata was read, error %v", err)
+	}
+}
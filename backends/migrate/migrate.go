@@ -0,0 +1,148 @@
+package migrate
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/minio/sha256-simd"
+)
+
+var VerifyErr = errors.New("migrate: copy does not match the source")
+
+type Options struct {
+	// Number of files to copy at the same time
+	Workers int
+
+	// Read every file back from the destination and compare its sha256
+	// with the source
+	Verify bool
+
+	// Only report what would be copied
+	DryRun bool
+
+	NoLogs bool
+}
+
+type migration struct {
+	src, dst backends.MetaStorageBackend
+	o        Options
+}
+
+func (mg migration) logf(format string, v ...interface{}) {
+	if !mg.o.NoLogs {
+		log.Printf(format, v...)
+	}
+}
+
+// checksum returns the sha256 of the bytes stored under key, which differs
+// from the one in the metadata for compressed or encrypted files.
+func checksum(b backends.StorageBackend, key string) (string, error) {
+	_, r, err := b.Get(key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// verified reports whether dst holds the same bytes as src under key.
+func (mg migration) verified(key string) (bool, error) {
+	srcSum, err := checksum(mg.src, key)
+	if err != nil {
+		return false, err
+	}
+	dstSum, err := checksum(mg.dst, key)
+	if err != nil {
+		return false, nil
+	}
+	return srcSum == dstSum, nil
+}
+
+func (mg migration) migrateFile(key string) error {
+	m, err := mg.src.Head(key)
+	if err != nil {
+		return err
+	}
+
+	dm, err := mg.dst.Head(key)
+	if err == nil && backends.SameMetadata(m, dm) {
+		if !mg.o.Verify {
+			return nil
+		}
+
+		ok, err := mg.verified(key)
+		if err != nil || ok {
+			return err
+		}
+		mg.logf("%s differs from the source", key)
+	}
+
+	if mg.o.DryRun {
+		mg.logf("Copy %s", key)
+		return nil
+	}
+
+	sum, err := backends.CopyFile(mg.src, mg.dst, key)
+	if err != nil {
+		return err
+	}
+
+	if mg.o.Verify {
+		dstSum, err := checksum(mg.dst, key)
+		if err != nil {
+			return err
+		}
+		if dstSum != sum {
+			return VerifyErr
+		}
+	}
+
+	mg.logf("Copied %s", key)
+	return nil
+}
+
+// Migrate copies every file and its metadata from src to dst. Files that
+// dst already holds with the same metadata are skipped, so an interrupted
+// migration can be resumed by running it again. It returns the number of
+// files that could not be copied.
+func Migrate(src, dst backends.MetaStorageBackend, o Options) (failed int, err error) {
+	if o.Workers < 1 {
+		o.Workers = 1
+	}
+	mg := migration{src: src, dst: dst, o: o}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	keys := make(chan string)
+	for i := 0; i < o.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				if err := mg.migrateFile(key); err != nil {
+					log.Printf("Failed to migrate %s: %v", key, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	err = src.List(func(key string) error {
+		keys <- key
+		return nil
+	})
+	close(keys)
+	wg.Wait()
+	return
+}
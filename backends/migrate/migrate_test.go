@@ -0,0 +1,131 @@
+package migrate
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/memory"
+)
+
+func readAll(t *testing.T, b backends.StorageBackend, key string) string {
+	_, r, err := b.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	data, _ := ioutil.ReadAll(r)
+	return string(data)
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linx-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := memory.NewMemoryBackend(0)
+	dst := localfs.NewLocalfsBackend(path.Join(dir, "meta"), path.Join(dir, "files"))
+
+	expiry := time.Now().Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("file%d.txt", i)
+		_, err = src.Put(key, strings.NewReader("File content "+key), backends.Metadata{Expiry: expiry, DeleteKey: "delkey", AccessKey: "acckey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, _ := zw.Create("a.txt")
+	f.Write([]byte("File content"))
+	zw.Close()
+	_, err = src.Put("test.zip", &buf, backends.Metadata{Expiry: expiry, DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stored compressed, only the metadata says so
+	m, _ := src.Head("file0.txt")
+	m.Encoding = "gzip"
+	src.PutMetadata("file0.txt", m)
+
+	failed, err := Migrate(src, dst, Options{Workers: 4, DryRun: true, NoLogs: true})
+	if err != nil || failed != 0 {
+		t.Fatalf("Dry run failed %d files: %v", failed, err)
+	}
+	if ok, _ := dst.Exists("file1.txt"); ok {
+		t.Fatal("Dry run copied a file")
+	}
+
+	failed, err = Migrate(src, dst, Options{Workers: 4, Verify: true, NoLogs: true})
+	if err != nil || failed != 0 {
+		t.Fatalf("Migration failed %d files: %v", failed, err)
+	}
+
+	err = src.List(func(key string) error {
+		sm, _ := src.Head(key)
+		dm, err := dst.Head(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !backends.SameMetadata(sm, dm) {
+			t.Fatalf("%s: metadata %+v instead of %+v", key, dm, sm)
+		}
+		if readAll(t, dst, key) != readAll(t, src, key) {
+			t.Fatalf("%s: contents differ", key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, _ = dst.Head("test.zip")
+	if strings.Join(m.ArchiveFiles, ",") != "a.txt" {
+		t.Fatalf("Archive files were %v", m.ArchiveFiles)
+	}
+}
+
+func TestResumeAndVerify(t *testing.T) {
+	src := memory.NewMemoryBackend(0)
+	dst := memory.NewMemoryBackend(0)
+
+	_, err := src.Put("test.txt", strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Migrate(src, dst, Options{NoLogs: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the copy without touching its metadata
+	m, _ := dst.Head("test.txt")
+	dst.Put("test.txt", strings.NewReader("File contenu"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	dst.PutMetadata("test.txt", m)
+
+	if _, err = Migrate(src, dst, Options{NoLogs: true}); err != nil {
+		t.Fatal(err)
+	}
+	if readAll(t, dst, "test.txt") != "File contenu" {
+		t.Fatal("Resuming copied a file that was already there")
+	}
+
+	if _, err = Migrate(src, dst, Options{Verify: true, NoLogs: true}); err != nil {
+		t.Fatal(err)
+	}
+	if readAll(t, dst, "test.txt") != "File content" {
+		t.Fatal("Verification did not replace a corrupt copy")
+	}
+}
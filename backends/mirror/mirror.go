@@ -0,0 +1,271 @@
+package mirror
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// MirrorBackend stores every file on all of its replicas, and reads from
+// the first replica that is available. A replica that is available but
+// doesn't have a file is trusted, so that files deleted while another
+// replica was unavailable don't come back. Replicas that miss writes can
+// be brought back in line with Resync.
+type MirrorBackend struct {
+	replicas []backends.MetaStorageBackend
+}
+
+func NewMirrorBackend(replicas ...backends.MetaStorageBackend) MirrorBackend {
+	return MirrorBackend{replicas: replicas}
+}
+
+// has reports whether replica holds key, so that writes which only make
+// sense for existing files aren't applied to lagging replicas. It fails
+// when the replica can't tell, which must not be taken for the file
+// missing.
+func has(replica backends.StorageBackend, key string) (bool, error) {
+	_, err := replica.Head(key)
+	if err == backends.NotFoundErr {
+		return false, nil
+	} else if err != nil && err != backends.BadMetadata {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b MirrorBackend) Delete(key string) (err error) {
+	for i, replica := range b.replicas {
+		ok, herr := has(replica, key)
+		if herr != nil {
+			log.Printf("Replica %d failed to look up %s for deletion: %v", i, key, herr)
+			if err == nil {
+				err = herr
+			}
+			continue
+		} else if !ok {
+			continue
+		}
+
+		rerr := replica.Delete(key)
+		if rerr != nil {
+			log.Printf("Replica %d failed to delete %s: %v", i, key, rerr)
+			if err == nil {
+				err = rerr
+			}
+		}
+	}
+	return
+}
+
+func (b MirrorBackend) Exists(key string) (ok bool, err error) {
+	for _, replica := range b.replicas {
+		ok, err = replica.Exists(key)
+		if ok {
+			return
+		}
+	}
+	return
+}
+
+func (b MirrorBackend) Head(key string) (m backends.Metadata, err error) {
+	for _, replica := range b.replicas {
+		var rerr error
+		m, rerr = replica.Head(key)
+		if rerr == nil || rerr == backends.NotFoundErr {
+			return m, rerr
+		}
+		if err == nil {
+			err = rerr
+		}
+	}
+	return
+}
+
+func (b MirrorBackend) Get(key string) (m backends.Metadata, r io.ReadCloser, err error) {
+	for _, replica := range b.replicas {
+		var rerr error
+		m, r, rerr = replica.Get(key)
+		if rerr == nil || rerr == backends.NotFoundErr {
+			return m, r, rerr
+		}
+		if err == nil {
+			err = rerr
+		}
+	}
+	return
+}
+
+// Put streams the upload to all replicas at once. It succeeds as long as
+// one of them stored the file; the others are logged and left for Resync.
+func (b MirrorBackend) Put(key string, r io.Reader, meta backends.Metadata) (m backends.Metadata, err error) {
+	type result struct {
+		m   backends.Metadata
+		err error
+	}
+
+	writers := make([]*io.PipeWriter, len(b.replicas))
+	results := make([]chan result, len(b.replicas))
+	for i, replica := range b.replicas {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		results[i] = make(chan result, 1)
+
+		go func(replica backends.StorageBackend, pr *io.PipeReader, c chan result) {
+			m, err := replica.Put(key, pr, meta)
+			if err != nil {
+				pr.CloseWithError(err)
+			} else {
+				pr.Close()
+			}
+			c <- result{m, err}
+		}(replica, pr, results[i])
+	}
+
+	// A replica that stops reading is dropped, the others carry on
+	buf := make([]byte, 32*1024)
+	live := len(writers)
+	var readErr error
+	for live > 0 {
+		n, rerr := r.Read(buf)
+		for i, w := range writers {
+			if w == nil || n == 0 {
+				continue
+			}
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				writers[i] = nil
+				live--
+			}
+		}
+
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			readErr = rerr
+			break
+		}
+	}
+
+	for _, w := range writers {
+		if w == nil {
+			continue
+		}
+		if readErr != nil {
+			w.CloseWithError(readErr)
+		} else {
+			w.Close()
+		}
+	}
+
+	stored := false
+	for i, c := range results {
+		res := <-c
+		if res.err != nil {
+			if readErr == nil && res.err != backends.FileEmptyError {
+				log.Printf("Replica %d failed to store %s: %v", i, key, res.err)
+			}
+			if err == nil {
+				err = res.err
+			}
+			continue
+		}
+
+		if !stored {
+			m = res.m
+			stored = true
+		}
+	}
+
+	if readErr != nil {
+		return m, readErr
+	}
+	if stored {
+		err = nil
+	}
+	return
+}
+
+// PutMetadata succeeds as long as one replica stored the metadata, except
+// when a replica couldn't be checked for the file, as it would come back
+// with stale metadata.
+func (b MirrorBackend) PutMetadata(key string, m backends.Metadata) (err error) {
+	stored := false
+	var unreachable error
+	for i, replica := range b.replicas {
+		ok, herr := has(replica, key)
+		if herr != nil {
+			log.Printf("Replica %d failed to look up %s to store its metadata: %v", i, key, herr)
+			unreachable = herr
+			continue
+		} else if !ok {
+			continue
+		}
+
+		rerr := replica.PutMetadata(key, m)
+		if rerr != nil {
+			log.Printf("Replica %d failed to store metadata for %s: %v", i, key, rerr)
+			err = rerr
+			continue
+		}
+		stored = true
+	}
+
+	if unreachable != nil {
+		return unreachable
+	} else if stored {
+		return nil
+	} else if err == nil {
+		return backends.NotFoundErr
+	}
+	return
+}
+
+func (b MirrorBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) (err error) {
+	for _, replica := range b.replicas {
+		// Backends check for the file before writing anything, so a
+		// failed attempt can be retried on the next replica
+		rerr := replica.ServeFile(key, w, r)
+		if rerr == nil || rerr == backends.NotFoundErr {
+			return rerr
+		}
+		if err == nil {
+			err = rerr
+		}
+	}
+	return
+}
+
+func (b MirrorBackend) Size(key string) (size int64, err error) {
+	for i, replica := range b.replicas {
+		var rerr error
+		size, rerr = replica.Size(key)
+		if rerr == nil {
+			return size, nil
+		}
+		if i == 0 {
+			err = rerr
+		}
+	}
+	return
+}
+
+// List lists every key held by any replica once.
+func (b MirrorBackend) List(fn func(key string) error) error {
+	for i, replica := range b.replicas {
+		err := replica.List(func(key string) error {
+			// keys are listed again if an earlier replica can't tell
+			// whether it holds them
+			for _, previous := range b.replicas[:i] {
+				if ok, _ := has(previous, key); ok {
+					return nil
+				}
+			}
+			return fn(key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
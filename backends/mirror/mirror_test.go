@@ -0,0 +1,207 @@
+package mirror
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
+)
+
+var errUnavailable = errors.New("unavailable")
+
+// brokenBackend fails every operation, like a replica on a dead disk
+type brokenBackend struct {
+	backends.MetaStorageBackend
+}
+
+func (b brokenBackend) Head(key string) (backends.Metadata, error) {
+	return backends.Metadata{}, errUnavailable
+}
+
+func (b brokenBackend) Get(key string) (backends.Metadata, io.ReadCloser, error) {
+	return backends.Metadata{}, nil, errUnavailable
+}
+
+func (b brokenBackend) Put(key string, r io.Reader, m backends.Metadata) (backends.Metadata, error) {
+	return backends.Metadata{}, errUnavailable
+}
+
+func (b brokenBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) error {
+	return errUnavailable
+}
+
+func readFile(t *testing.T, b backends.StorageBackend, key string) string {
+	_, r, err := b.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPutToAllReplicas(t *testing.T) {
+	a := memory.NewMemoryBackend(0)
+	c := memory.NewMemoryBackend(0)
+	b := NewMirrorBackend(a, c)
+
+	content := strings.Repeat("File content", 10000)
+	m, err := b.Put("test.txt", strings.NewReader(content), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != int64(len(content)) {
+		t.Fatalf("Wrong size %d", m.Size)
+	}
+
+	for _, replica := range []backends.StorageBackend{a, c} {
+		if readFile(t, replica, "test.txt") != content {
+			t.Fatal("Replica does not hold the upload")
+		}
+	}
+
+	m.AccessKey = "acckey"
+	err = b.PutMetadata("test.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm, _ := c.Head("test.txt"); cm.AccessKey != "acckey" {
+		t.Fatal("Metadata was not mirrored")
+	}
+
+	err = b.Delete("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, replica := range []backends.StorageBackend{a, c} {
+		if ok, _ := replica.Exists("test.txt"); ok {
+			t.Fatal("File was left on a replica after delete")
+		}
+	}
+
+	_, err = b.Put("empty.txt", strings.NewReader(""), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != backends.FileEmptyError {
+		t.Fatalf("Expected FileEmptyError, got %v", err)
+	}
+}
+
+func TestBrokenReplica(t *testing.T) {
+	healthy := memory.NewMemoryBackend(0)
+	b := NewMirrorBackend(brokenBackend{memory.NewMemoryBackend(0)}, healthy)
+
+	_, err := b.Put("test.txt", strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readFile(t, b, "test.txt") != "File content" {
+		t.Fatal("File was not read from the healthy replica")
+	}
+
+	w := httptest.NewRecorder()
+	err = b.ServeFile("test.txt", w, httptest.NewRequest("GET", "/selif/test.txt", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.String() != "File content" {
+		t.Fatalf("Served %q", w.Body.String())
+	}
+
+	if _, err = b.Head("missing.txt"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr, got %v", err)
+	}
+
+	// writes can't be known to have reached the broken replica
+	m, _ := healthy.Head("test.txt")
+	if err = b.PutMetadata("test.txt", m); err != errUnavailable {
+		t.Fatalf("Expected errUnavailable from PutMetadata, got %v", err)
+	}
+	if err = b.Delete("test.txt"); err != errUnavailable {
+		t.Fatalf("Expected errUnavailable from Delete, got %v", err)
+	}
+	if ok, _ := healthy.Exists("test.txt"); ok {
+		t.Fatal("File was left on the healthy replica")
+	}
+}
+
+func TestMissingOnHealthyReplica(t *testing.T) {
+	stale := memory.NewMemoryBackend(0)
+	b := NewMirrorBackend(memory.NewMemoryBackend(0), stale)
+
+	// e.g. deleted while the second replica was unavailable
+	_, err := stale.Put("deleted.txt", strings.NewReader("Old content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = b.Head("deleted.txt"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr from Head, got %v", err)
+	}
+	if _, _, err = b.Get("deleted.txt"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr from Get, got %v", err)
+	}
+	w := httptest.NewRecorder()
+	err = b.ServeFile("deleted.txt", w, httptest.NewRequest("GET", "/selif/deleted.txt", nil))
+	if err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr from ServeFile, got %v", err)
+	}
+}
+
+func TestResync(t *testing.T) {
+	a := memory.NewMemoryBackend(0)
+	lagging := memory.NewMemoryBackend(0)
+
+	for _, key := range []string{"one.txt", "two.txt"} {
+		_, err := a.Put(key, strings.NewReader("File content "+key), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, _ := a.Head("one.txt")
+	m.AccessKey = "acckey"
+	m.ArchiveFiles = []string{"inside.txt"}
+	a.PutMetadata("one.txt", m)
+
+	_, err := lagging.Put("one.txt", strings.NewReader("File content one.txt"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lagging.Put("deleted.txt", strings.NewReader("Old content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Resync(a, lagging, ResyncOptions{DryRun: true, DeleteExtra: true, NoLogs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := lagging.Exists("two.txt"); ok {
+		t.Fatal("Dry run copied a file")
+	}
+
+	err = Resync(a, lagging, ResyncOptions{DeleteExtra: true, NoLogs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readFile(t, lagging, "two.txt") != "File content two.txt" {
+		t.Fatal("Missing file was not copied")
+	}
+	if lm, _ := lagging.Head("one.txt"); lm.AccessKey != "acckey" || len(lm.ArchiveFiles) != 1 {
+		t.Fatal("Changed metadata was not copied")
+	}
+	if ok, _ := lagging.Exists("deleted.txt"); ok {
+		t.Fatal("Extra file was not deleted")
+	}
+}
@@ -0,0 +1,77 @@
+package mirror
+
+import (
+	"log"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+type ResyncOptions struct {
+	// Delete files from the destination that the source doesn't have
+	DeleteExtra bool
+
+	// Only report what would be changed
+	DryRun bool
+
+	NoLogs bool
+}
+
+// Resync makes dst hold the same files and metadata as src, copying only
+// what is missing or differs.
+func Resync(src, dst backends.MetaStorageBackend, o ResyncOptions) error {
+	logf := func(format string, v ...interface{}) {
+		if !o.NoLogs {
+			log.Printf(format, v...)
+		}
+	}
+
+	err := src.List(func(key string) error {
+		m, err := src.Head(key)
+		if err != nil {
+			log.Printf("Skipping %s, could not read its metadata: %v", key, err)
+			return nil
+		}
+
+		dm, err := dst.Head(key)
+		if err == nil && backends.SameMetadata(m, dm) {
+			return nil
+		}
+
+		if err == nil && dm.Sha256sum == m.Sha256sum {
+			logf("Update metadata of %s", key)
+			if o.DryRun {
+				return nil
+			}
+			err = dst.PutMetadata(key, m)
+		} else {
+			logf("Copy %s", key)
+			if o.DryRun {
+				return nil
+			}
+			_, err = backends.CopyFile(src, dst, key)
+		}
+		if err != nil {
+			log.Printf("Failed to resync %s: %v", key, err)
+		}
+		return nil
+	})
+	if err != nil || !o.DeleteExtra {
+		return err
+	}
+
+	return dst.List(func(key string) error {
+		_, err := src.Head(key)
+		if err != backends.NotFoundErr {
+			return nil
+		}
+
+		logf("Delete %s", key)
+		if !o.DryRun {
+			err = dst.Delete(key)
+			if err != nil {
+				log.Printf("Failed to delete %s: %v", key, err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,75 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/helpers"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Archive listings don't fit in the object's metadata, which S3 limits to
+// 2KB, so they are stored as a separate JSON object under this prefix
+const archivesPrefix = internalPrefix + "archives/"
+
+type archiveJSON struct {
+	ArchiveFiles []string `json:"archive_files"`
+}
+
+// List the contents of an uploaded archive, reading only the parts of the
+// object that are needed
+func (b S3Backend) listArchiveFiles(key string, m backends.Metadata) ([]string, error) {
+	r := newObjectReader(b, key, m.Size)
+	defer r.Close()
+
+	return helpers.ListArchiveFiles(m.Mimetype, m.Size, r)
+}
+
+func (b S3Backend) writeArchiveFiles(key string, files []string) error {
+	data, err := json.Marshal(archiveJSON{ArchiveFiles: files})
+	if err != nil {
+		return err
+	}
+
+	_, err = b.svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(archivesPrefix + key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// Fill in the archive listing of an object if it has one. The listing is
+// only informational, so failing to read it is not an error.
+func (b S3Backend) readArchiveFiles(key string, input map[string]*string, m *backends.Metadata) {
+	count, err := strconv.Atoi(aws.StringValue(input["Archivefiles"]))
+	if err != nil || count == 0 {
+		return
+	}
+
+	result, err := b.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(archivesPrefix + key),
+	})
+	if err != nil {
+		return
+	}
+	defer result.Body.Close()
+
+	var ajson archiveJSON
+	if json.NewDecoder(result.Body).Decode(&ajson) == nil {
+		m.ArchiveFiles = ajson.ArchiveFiles
+	}
+}
+
+func (b S3Backend) deleteArchiveFiles(key string) error {
+	_, err := b.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(archivesPrefix + key),
+	})
+	return err
+}
@@ -0,0 +1,91 @@
+package s3
+
+import (
+	"fmt"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Objects used by linx-server itself live under this prefix. Upload keys
+// can't contain an underscore, so they never collide with it.
+const internalPrefix = "_linx/"
+
+// Uploads in progress. A lifecycle rule on this prefix can be used to clean
+// up after uploads that were interrupted by a crash.
+const incomingPrefix = internalPrefix + "incoming/"
+
+// Largest object that can be copied with a single CopyObject request
+const maxCopySize = 5 * 1024 * 1024 * 1024
+
+// Size of each part when copying larger objects
+const copyPartSize = 512 * 1024 * 1024
+
+// Copy the object at src to dst, replacing its metadata with m
+func (b S3Backend) copyObject(src, dst string, size int64, m backends.Metadata) error {
+	if size > maxCopySize {
+		return b.copyObjectMultipart(src, dst, size, m)
+	}
+
+	_, err := b.svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(b.bucket),
+		Key:               aws.String(dst),
+		CopySource:        aws.String("/" + b.bucket + "/" + src),
+		ContentType:       aws.String(m.Mimetype),
+		Metadata:          mapMetadata(m),
+		MetadataDirective: aws.String("REPLACE"),
+	})
+	return err
+}
+
+func (b S3Backend) copyObjectMultipart(src, dst string, size int64, m backends.Metadata) error {
+	upload, err := b.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(dst),
+		ContentType: aws.String(m.Mimetype),
+		Metadata:    mapMetadata(m),
+	})
+	if err != nil {
+		return err
+	}
+
+	var parts []*s3.CompletedPart
+	for start := int64(0); start < size; start += copyPartSize {
+		end := start + copyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		partNumber := aws.Int64(int64(len(parts) + 1))
+
+		result, err := b.svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(b.bucket),
+			Key:             aws.String(dst),
+			CopySource:      aws.String("/" + b.bucket + "/" + src),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			PartNumber:      partNumber,
+			UploadId:        upload.UploadId,
+		})
+		if err != nil {
+			b.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(b.bucket),
+				Key:      aws.String(dst),
+				UploadId: upload.UploadId,
+			})
+			return err
+		}
+
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       result.CopyPartResult.ETag,
+			PartNumber: partNumber,
+		})
+	}
+
+	_, err = b.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.bucket),
+		Key:             aws.String(dst),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
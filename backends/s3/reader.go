@@ -0,0 +1,128 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Forward seeks up to this distance read through the open response instead
+// of starting a new request
+const seekDiscardLimit = 64 * 1024
+
+var errInvalidSeek = errors.New("s3: invalid seek")
+
+// objectReader reads an object with ranged GET requests, so that callers
+// can seek within it without downloading the whole object
+type objectReader struct {
+	b      S3Backend
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func newObjectReader(b S3Backend, key string, size int64) *objectReader {
+	return &objectReader{b: b, key: key, size: size}
+}
+
+func (o *objectReader) getRange(start, end int64) (io.ReadCloser, error) {
+	result, err := o.b.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(o.b.bucket),
+		Key:    aws.String(o.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, nil
+}
+
+func (o *objectReader) Read(p []byte) (n int, err error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		o.body, err = o.getRange(o.offset, o.size-1)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err = o.body.Read(p)
+	o.offset += int64(n)
+	if err == io.EOF && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errInvalidSeek
+	}
+	if offset < 0 {
+		return 0, errInvalidSeek
+	}
+
+	if o.body != nil && offset != o.offset {
+		delta := offset - o.offset
+		if delta > 0 && delta <= seekDiscardLimit {
+			n, err := io.CopyN(ioutil.Discard, o.body, delta)
+			o.offset += n
+			if err == nil {
+				return o.offset, nil
+			}
+		}
+
+		o.body.Close()
+		o.body = nil
+	}
+
+	o.offset = offset
+	return o.offset, nil
+}
+
+func (o *objectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+
+	end := off + int64(len(p)) - 1
+	if end >= o.size {
+		end = o.size - 1
+	}
+
+	body, err := o.getRange(off, end)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p[:end-off+1])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o *objectReader) Close() error {
+	if o.body == nil {
+		return nil
+	}
+
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
@@ -1,11 +1,11 @@
 package s3
 
 import (
+	"bytes"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/andreimarcu/linx-server/backends"
@@ -15,6 +15,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/dchest/uniuri"
 )
 
 type S3Backend struct {
@@ -30,6 +31,10 @@ func (b S3Backend) Delete(key string) error {
 	if err != nil {
 		return err
 	}
+
+	// Deleting an object that doesn't exist succeeds, so this is safe for
+	// objects without an archive listing
+	b.deleteArchiveFiles(key)
 	return nil
 }
 
@@ -57,6 +62,11 @@ func (b S3Backend) Head(key string) (metadata backends.Metadata, err error) {
 	}
 
 	metadata, err = unmapMetadata(result.Metadata)
+	if err != nil {
+		return
+	}
+
+	b.readArchiveFiles(key, result.Metadata, &metadata)
 	return
 }
 
@@ -76,33 +86,22 @@ func (b S3Backend) Get(key string) (metadata backends.Metadata, r io.ReadCloser,
 	}
 
 	metadata, err = unmapMetadata(result.Metadata)
+	if err != nil {
+		result.Body.Close()
+		return
+	}
+
+	b.readArchiveFiles(key, result.Metadata, &metadata)
 	r = result.Body
 	return
 }
 
 func (b S3Backend) ServeFile(key string, w http.ResponseWriter, r *http.Request) (err error) {
-	var result *s3.GetObjectOutput
-
-	if r.Header.Get("Range") != "" {
-		result, err = b.svc.GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(b.bucket),
-			Key:    aws.String(key),
-			Range:  aws.String(r.Header.Get("Range")),
-		})
-
-		w.WriteHeader(206)
-		w.Header().Set("Content-Range", *result.ContentRange)
-		w.Header().Set("Content-Length", strconv.FormatInt(*result.ContentLength, 10))
-		w.Header().Set("Accept-Ranges", "bytes")
-
-	} else {
-		result, err = b.svc.GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(b.bucket),
-			Key:    aws.String(key),
-		})
-
-	}
-
+	var result *s3.HeadObjectOutput
+	result, err = b.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			if aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound" {
@@ -112,13 +111,31 @@ func (b S3Backend) ServeFile(key string, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	_, err = io.Copy(w, result.Body)
+	modtime := time.Unix(0, 0)
+	if result.LastModified != nil {
+		modtime = *result.LastModified
+	}
+
+	// ServeContent takes care of conditional and multi-range requests,
+	// fetching only the requested ranges from the bucket
+	content := newObjectReader(b, key, aws.Int64Value(result.ContentLength))
+	defer content.Close()
+	http.ServeContent(w, r, key, modtime, content)
 
 	return
 }
 
+func (b S3Backend) PresignURL(key, mimetype string, expiry time.Duration) (string, error) {
+	req, _ := b.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:              aws.String(b.bucket),
+		Key:                 aws.String(key),
+		ResponseContentType: aws.String(mimetype),
+	})
+	return req.Presign(expiry)
+}
+
 func mapMetadata(m backends.Metadata) map[string]*string {
-	return map[string]*string{
+	metadata := map[string]*string{
 		"Expiry":    aws.String(strconv.FormatInt(m.Expiry.Unix(), 10)),
 		"Deletekey": aws.String(m.DeleteKey),
 		"Size":      aws.String(strconv.FormatInt(m.Size, 10)),
@@ -126,6 +143,30 @@ func mapMetadata(m backends.Metadata) map[string]*string {
 		"Sha256sum": aws.String(m.Sha256sum),
 		"AccessKey": aws.String(m.AccessKey),
 	}
+
+	// The listing itself is stored separately, see archive.go
+	if len(m.ArchiveFiles) > 0 {
+		metadata["Archivefiles"] = aws.String(strconv.Itoa(len(m.ArchiveFiles)))
+	}
+
+	if m.Encoding != "" {
+		metadata["Encoding"] = aws.String(m.Encoding)
+	}
+
+	if m.Encrypted {
+		metadata["Encrypted"] = aws.String("true")
+	}
+
+	if m.MaxDownloads > 0 {
+		metadata["Maxdownloads"] = aws.String(strconv.FormatInt(m.MaxDownloads, 10))
+		metadata["Downloads"] = aws.String(strconv.FormatInt(m.Downloads, 10))
+	}
+
+	if !m.Deadline.IsZero() {
+		metadata["Deadline"] = aws.String(strconv.FormatInt(m.Deadline.Unix(), 10))
+	}
+
+	return metadata
 }
 
 func unmapMetadata(input map[string]*string) (m backends.Metadata, err error) {
@@ -147,77 +188,140 @@ func unmapMetadata(input map[string]*string) (m backends.Metadata, err error) {
 
 	m.Mimetype = aws.StringValue(input["Mimetype"])
 	m.Sha256sum = aws.StringValue(input["Sha256sum"])
+	m.Encoding = aws.StringValue(input["Encoding"])
+	m.Encrypted = aws.StringValue(input["Encrypted"]) == "true"
 
-	if key, ok := input["AccessKey"]; ok {
-		m.AccessKey = aws.StringValue(key)
+	if input["Maxdownloads"] != nil {
+		m.MaxDownloads, err = strconv.ParseInt(aws.StringValue(input["Maxdownloads"]), 10, 64)
+		if err != nil {
+			return
+		}
+		m.Downloads, err = strconv.ParseInt(aws.StringValue(input["Downloads"]), 10, 64)
+		if err != nil {
+			return
+		}
 	}
 
-	return
-}
+	if input["Deadline"] != nil {
+		var deadline int64
+		deadline, err = strconv.ParseInt(aws.StringValue(input["Deadline"]), 10, 64)
+		if err != nil {
+			return
+		}
+		m.Deadline = time.Unix(deadline, 0)
+	}
 
-func (b S3Backend) Put(key string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (m backends.Metadata, err error) {
-	tmpDst, err := ioutil.TempFile("", "linx-server-upload")
-	if err != nil {
-		return m, err
+	// The SDK canonicalizes the names of metadata it reads back
+	m.AccessKey = aws.StringValue(input["Accesskey"])
+	if m.AccessKey == "" {
+		m.AccessKey = aws.StringValue(input["AccessKey"])
 	}
-	defer tmpDst.Close()
-	defer os.Remove(tmpDst.Name())
 
-	bytes, err := io.Copy(tmpDst, r)
-	if bytes == 0 {
+	return
+}
+
+func (b S3Backend) Put(key string, r io.Reader, meta backends.Metadata) (m backends.Metadata, err error) {
+	// Make sure there is something to upload before talking to S3
+	header := make([]byte, 512)
+	n, err := io.ReadFull(r, header)
+	if n == 0 {
 		return m, backends.FileEmptyError
-	} else if err != nil {
+	} else if err != nil && err != io.ErrUnexpectedEOF {
 		return m, err
 	}
 
-	_, err = tmpDst.Seek(0, 0)
+	// The metadata is computed while the upload streams through, so it
+	// isn't known until the upload is complete. Upload to a temporary key
+	// and copy the object into place with its final metadata, so that the
+	// key never points at a partial upload.
+	hasher := helpers.NewMetadataHasher()
+	body := io.TeeReader(io.MultiReader(bytes.NewReader(header[:n]), r), hasher)
+	tmpKey := incomingPrefix + key + "-" + uniuri.New()
+
+	uploader := s3manager.NewUploaderWithClient(b.svc)
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(tmpKey),
+		Body:   body,
+	}
+	_, err = uploader.Upload(input)
 	if err != nil {
-		return m, err
+		return
+	}
+	defer b.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(tmpKey),
+	})
+
+	m = hasher.Complete(meta)
+
+	m.ArchiveFiles, _ = b.listArchiveFiles(tmpKey, m)
+	if len(m.ArchiveFiles) > 0 {
+		err = b.writeArchiveFiles(key, m.ArchiveFiles)
+		if err != nil {
+			return
+		}
 	}
 
-	m, err = helpers.GenerateMetadata(tmpDst)
+	err = b.copyObject(tmpKey, key, m.Size, m)
 	if err != nil {
+		// don't leave the listing behind without an object it belongs to
+		if len(m.ArchiveFiles) > 0 {
+			if exists, _ := b.Exists(key); !exists {
+				b.deleteArchiveFiles(key)
+			}
+		}
 		return
 	}
-	m.Expiry = expiry
-	m.DeleteKey = deleteKey
-	m.AccessKey = accessKey
-	// XXX: we may not be able to write this to AWS easily
-	//m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, tmpDst)
 
-	_, err = tmpDst.Seek(0, 0)
+	return
+}
+
+func (b S3Backend) PutMetadata(key string, m backends.Metadata) (err error) {
+	result, err := b.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		return m, err
+		return
 	}
 
-	uploader := s3manager.NewUploaderWithClient(b.svc)
-	input := &s3manager.UploadInput{
-		Bucket:   aws.String(b.bucket),
-		Key:      aws.String(key),
-		Body:     tmpDst,
-		Metadata: mapMetadata(m),
+	if len(m.ArchiveFiles) > 0 {
+		err = b.writeArchiveFiles(key, m.ArchiveFiles)
+		if err != nil {
+			return
+		}
 	}
-	_, err = uploader.Upload(input)
+
+	err = b.copyObject(key, key, aws.Int64Value(result.ContentLength), m)
 	if err != nil {
 		return
 	}
 
+	// the listing was dropped from the metadata
+	if len(m.ArchiveFiles) == 0 && result.Metadata["Archivefiles"] != nil {
+		err = b.deleteArchiveFiles(key)
+	}
 	return
 }
 
-func (b S3Backend) PutMetadata(key string, m backends.Metadata) (err error) {
-	_, err = b.svc.CopyObject(&s3.CopyObjectInput{
-		Bucket:            aws.String(b.bucket),
-		Key:               aws.String(key),
-		CopySource:        aws.String("/" + b.bucket + "/" + key),
-		Metadata:          mapMetadata(m),
-		MetadataDirective: aws.String("REPLACE"),
+// ModTime returns when the object stored under key was last written, which
+// includes changes to its metadata.
+func (b S3Backend) ModTime(key string) (time.Time, error) {
+	result, err := b.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
 	})
 	if err != nil {
-		return
+		if aerr, ok := err.(awserr.Error); ok {
+			if aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound" {
+				err = backends.NotFoundErr
+			}
+		}
+		return time.Time{}, err
 	}
 
-	return
+	return aws.TimeValue(result.LastModified), nil
 }
 
 func (b S3Backend) Size(key string) (int64, error) {
@@ -233,22 +337,32 @@ func (b S3Backend) Size(key string) (int64, error) {
 	return *result.ContentLength, nil
 }
 
-func (b S3Backend) List() ([]string, error) {
-	var output []string
-	input := &s3.ListObjectsInput{
+func (b S3Backend) List(fn func(key string) error) error {
+	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(b.bucket),
 	}
 
-	results, err := b.svc.ListObjects(input)
-	if err != nil {
-		return nil, err
-	}
+	// Each page holds at most 1000 keys, keep following the continuation
+	// token until the bucket is exhausted
+	var fnErr error
+	err := b.svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if strings.HasPrefix(*object.Key, internalPrefix) {
+				continue
+			}
 
-	for _, object := range results.Contents {
-		output = append(output, *object.Key)
+			fnErr = fn(*object.Key)
+			if fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
 	}
 
-	return output, nil
+	return err
 }
 
 func NewS3Backend(bucket string, region string, endpoint string, forcePathStyle bool) S3Backend {
@@ -0,0 +1,725 @@
+package s3
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/cleanup"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const testBucket = "linx"
+
+type fakeObject struct {
+	data         []byte
+	contentType  string
+	metadata     http.Header
+	lastModified time.Time
+}
+
+type fakeUpload struct {
+	key         string
+	contentType string
+	metadata    http.Header
+	parts       map[int][]byte
+}
+
+// fakeS3 implements just enough of the S3 REST API, with path-style
+// addressing, for the backend to be tested without a real bucket
+type fakeS3 struct {
+	sync.Mutex
+	objects    map[string]*fakeObject
+	uploads    map[string]*fakeUpload
+	requests   []string
+	failCopies bool
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string]*fakeObject),
+		uploads: make(map[string]*fakeUpload),
+	}
+}
+
+func newTestBackend(t *testing.T) (S3Backend, *fakeS3, func()) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+
+	return S3Backend{bucket: testBucket, svc: s3.New(sess)}, fake, server.Close
+}
+
+func fakeMetadata(h http.Header) http.Header {
+	m := make(http.Header)
+	for k, v := range h {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func fakeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+testBucket)
+	key := strings.TrimPrefix(path, "/")
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if key == "" && r.Method == "GET" {
+		f.list(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			srcKey := strings.TrimPrefix(src, "/"+testBucket+"/")
+			obj, ok := f.objects[srcKey]
+			if !ok {
+				fakeError(w, 404, "NoSuchKey")
+				return
+			}
+			if f.failCopies {
+				fakeError(w, 403, "AccessDenied")
+				return
+			}
+
+			if uploadID := query.Get("uploadId"); uploadID != "" {
+				var start, end int
+				fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+				part, _ := strconv.Atoi(query.Get("partNumber"))
+				f.uploads[uploadID].parts[part] = append([]byte{}, obj.data[start:end+1]...)
+				writeXML(w, struct {
+					XMLName xml.Name `xml:"CopyPartResult"`
+					ETag    string
+				}{ETag: "\"part\""})
+				return
+			}
+
+			copied := &fakeObject{
+				data:         obj.data,
+				contentType:  obj.contentType,
+				metadata:     obj.metadata,
+				lastModified: time.Now(),
+			}
+			if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+				copied.contentType = r.Header.Get("Content-Type")
+				copied.metadata = fakeMetadata(r.Header)
+			}
+			f.objects[key] = copied
+			writeXML(w, struct {
+				XMLName xml.Name `xml:"CopyObjectResult"`
+				ETag    string
+			}{ETag: "\"copy\""})
+			return
+		}
+
+		if uploadID := query.Get("uploadId"); uploadID != "" {
+			part, _ := strconv.Atoi(query.Get("partNumber"))
+			f.uploads[uploadID].parts[part] = body
+			w.Header().Set("ETag", "\"part\"")
+			return
+		}
+
+		f.objects[key] = &fakeObject{
+			data:         body,
+			contentType:  r.Header.Get("Content-Type"),
+			metadata:     fakeMetadata(r.Header),
+			lastModified: time.Now(),
+		}
+		w.Header().Set("ETag", "\"object\"")
+
+	case "POST":
+		if _, ok := query["uploads"]; ok {
+			uploadID := strconv.Itoa(len(f.uploads) + 1)
+			f.uploads[uploadID] = &fakeUpload{
+				key:         key,
+				contentType: r.Header.Get("Content-Type"),
+				metadata:    fakeMetadata(r.Header),
+				parts:       make(map[int][]byte),
+			}
+			writeXML(w, struct {
+				XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+				Bucket   string
+				Key      string
+				UploadId string
+			}{Bucket: testBucket, Key: key, UploadId: uploadID})
+			return
+		}
+
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			fakeError(w, 404, "NoSuchUpload")
+			return
+		}
+		var numbers []int
+		for n := range upload.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, upload.parts[n]...)
+		}
+		f.objects[key] = &fakeObject{
+			data:         data,
+			contentType:  upload.contentType,
+			metadata:     upload.metadata,
+			lastModified: time.Now(),
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: testBucket, Key: key, ETag: "\"object\""})
+
+	case "DELETE":
+		if uploadID := query.Get("uploadId"); uploadID != "" {
+			delete(f.uploads, uploadID)
+		} else {
+			delete(f.objects, key)
+		}
+		w.WriteHeader(204)
+
+	case "HEAD", "GET":
+		obj, ok := f.objects[key]
+		if !ok {
+			fakeError(w, 404, "NoSuchKey")
+			return
+		}
+
+		for k, v := range obj.metadata {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("Last-Modified", obj.lastModified.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", "\"object\"")
+
+		data := obj.data
+		status := 200
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, end, ok := parseFakeRange(rng, int64(len(data)))
+			if !ok {
+				fakeError(w, 416, "InvalidRange")
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			status = 206
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+
+	default:
+		fakeError(w, 405, "MethodNotAllowed")
+	}
+}
+
+// Parse a single byte range the way S3 does
+func parseFakeRange(rng string, size int64) (start, end int64, ok bool) {
+	spec := strings.TrimPrefix(rng, "bytes=")
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+
+	if parts[0] == "" {
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if parts[1] != "" {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+type fakeListContents struct {
+	Key  string
+	Size int64
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	after := query.Get("continuation-token")
+	if after == "" {
+		after = query.Get("start-after")
+	}
+	if after == "" {
+		after = query.Get("marker")
+	}
+	maxKeys := 1000
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n < maxKeys {
+		maxKeys = n
+	}
+
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	truncated := len(keys) > maxKeys
+	if truncated {
+		keys = keys[:maxKeys]
+	}
+
+	var contents []fakeListContents
+	for _, k := range keys {
+		contents = append(contents, fakeListContents{Key: k, Size: int64(len(f.objects[k].data))})
+	}
+
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		Contents              []fakeListContents
+		NextContinuationToken string `xml:",omitempty"`
+		NextMarker            string `xml:",omitempty"`
+	}{
+		Name:        testBucket,
+		Prefix:      prefix,
+		KeyCount:    len(contents),
+		MaxKeys:     maxKeys,
+		IsTruncated: truncated,
+		Contents:    contents,
+	}
+	if truncated {
+		result.NextContinuationToken = keys[len(keys)-1]
+		result.NextMarker = keys[len(keys)-1]
+	}
+	writeXML(w, result)
+}
+
+func TestPutAndGet(t *testing.T) {
+	b, fake, done := newTestBackend(t)
+	defer done()
+
+	m, err := b.Put("test.txt", strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey", AccessKey: "acckey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Size != 12 {
+		t.Fatalf("Size was %d instead of 12", m.Size)
+	}
+	if m.Sha256sum != "f0ca7ef61aed3763f9bec72e14379549179c5d31cc25f23a6e62fcdc43f3374c" {
+		t.Fatalf("Unexpected sha256sum %q", m.Sha256sum)
+	}
+
+	for k := range fake.objects {
+		if strings.HasPrefix(k, internalPrefix) {
+			t.Fatalf("Temporary object %s was left behind", k)
+		}
+	}
+
+	head, err := b.Head("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Sha256sum != m.Sha256sum || head.Size != 12 || head.DeleteKey != "delkey" || head.AccessKey != "acckey" {
+		t.Fatalf("Head returned unexpected metadata %+v", head)
+	}
+	if !strings.HasPrefix(head.Mimetype, "text/plain") {
+		t.Fatalf("Mimetype was %q", head.Mimetype)
+	}
+
+	head.MaxDownloads = 3
+	head.Downloads = 1
+	if err = b.PutMetadata("test.txt", head); err != nil {
+		t.Fatal(err)
+	}
+	if head, err = b.Head("test.txt"); err != nil || head.MaxDownloads != 3 || head.Downloads != 1 {
+		t.Fatalf("Download count was not stored: %+v %v", head, err)
+	}
+
+	_, r, err := b.Get("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	contents, _ := ioutil.ReadAll(r)
+	if string(contents) != "File content" {
+		t.Fatalf("Contents were %q", contents)
+	}
+}
+
+func TestPutEmpty(t *testing.T) {
+	b, fake, done := newTestBackend(t)
+	defer done()
+
+	_, err := b.Put("empty.txt", bytes.NewReader(nil), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err == nil {
+		t.Fatal("Empty upload was accepted")
+	}
+	if len(fake.requests) != 0 {
+		t.Fatalf("Empty upload reached S3: %v", fake.requests)
+	}
+}
+
+func TestPutLarge(t *testing.T) {
+	b, _, done := newTestBackend(t)
+	defer done()
+
+	// Large enough to be sent as a multipart upload
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024)
+	m, err := b.Put("large.bin", bytes.NewReader(data), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := b.Size("large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) || m.Size != int64(len(data)) {
+		t.Fatalf("Size was %d/%d instead of %d", size, m.Size, len(data))
+	}
+}
+
+func TestListPaginates(t *testing.T) {
+	b, fake, done := newTestBackend(t)
+	defer done()
+
+	for i := 0; i < 2500; i++ {
+		fake.objects[fmt.Sprintf("file%04d.txt", i)] = &fakeObject{data: []byte("x")}
+	}
+	fake.objects[incomingPrefix+"partial"] = &fakeObject{data: []byte("x")}
+
+	seen := make(map[string]bool)
+	err := b.List(func(key string) error {
+		seen[key] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != 2500 {
+		t.Fatalf("Listed %d keys instead of 2500", len(seen))
+	}
+	if seen[incomingPrefix+"partial"] {
+		t.Fatal("Internal object was listed")
+	}
+}
+
+func TestArchiveFiles(t *testing.T) {
+	b, fake, done := newTestBackend(t)
+	defer done()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"b.txt", "a.txt"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("File content"))
+	}
+	zw.Close()
+
+	m, err := b.Put("test.zip", &buf, backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(m.ArchiveFiles, ",") != "a.txt,b.txt" {
+		t.Fatalf("Put listed %v", m.ArchiveFiles)
+	}
+
+	head, err := b.Head("test.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(head.ArchiveFiles, ",") != "a.txt,b.txt" {
+		t.Fatalf("Head listed %v", head.ArchiveFiles)
+	}
+
+	// the listing must survive metadata updates
+	head.Expiry = time.Now().Add(time.Hour)
+	if err := b.PutMetadata("test.zip", head); err != nil {
+		t.Fatal(err)
+	}
+	m, r, err := b.Get("test.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if strings.Join(m.ArchiveFiles, ",") != "a.txt,b.txt" {
+		t.Fatalf("Get listed %v", m.ArchiveFiles)
+	}
+
+	if err := b.Delete("test.zip"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 0 {
+		t.Fatal("Archive listing was not deleted along with the object")
+	}
+}
+
+func TestArchiveFilesCleanup(t *testing.T) {
+	b, fake, done := newTestBackend(t)
+	defer done()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("File content"))
+	zw.Close()
+	data := buf.Bytes()
+
+	hasListing := func() bool {
+		fake.Lock()
+		defer fake.Unlock()
+		_, ok := fake.objects[archivesPrefix+"test.zip"]
+		return ok
+	}
+
+	// a failed upload leaves no listing behind
+	fake.Lock()
+	fake.failCopies = true
+	fake.Unlock()
+	_, err = b.Put("test.zip", bytes.NewReader(data), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err == nil {
+		t.Fatal("Put succeeded although the object could not be copied into place")
+	}
+	if hasListing() {
+		t.Fatal("Archive listing was left behind by a failed upload")
+	}
+	fake.Lock()
+	fake.failCopies = false
+	fake.Unlock()
+
+	// and dropping the listing from the metadata deletes it
+	m, err := b.Put("test.zip", bytes.NewReader(data), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasListing() {
+		t.Fatal("Archive listing was not stored")
+	}
+	m.ArchiveFiles = nil
+	if err := b.PutMetadata("test.zip", m); err != nil {
+		t.Fatal(err)
+	}
+	if hasListing() {
+		t.Fatal("Archive listing was kept after it was dropped from the metadata")
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	b, fake, done := newTestBackend(t)
+	defer done()
+
+	_, err := b.Put("expired.txt", strings.NewReader("old"), backends.Metadata{Expiry: time.Now().Add(-time.Minute), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Put("live.txt", strings.NewReader("new"), backends.Metadata{Expiry: time.Now().Add(time.Hour), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Put("forever.txt", strings.NewReader("new"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cleanup.Cleanup(b, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := fake.objects["expired.txt"]; ok {
+		t.Fatal("Expired object was not deleted")
+	}
+	if _, ok := fake.objects["live.txt"]; !ok {
+		t.Fatal("Unexpired object was deleted")
+	}
+	if _, ok := fake.objects["forever.txt"]; !ok {
+		t.Fatal("Object without expiry was deleted")
+	}
+}
+
+func TestPresignURL(t *testing.T) {
+	b, _, done := newTestBackend(t)
+	defer done()
+
+	u, err := b.PresignURL("test.txt", "text/plain", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(u, "/"+testBucket+"/test.txt?") {
+		t.Fatalf("Presigned URL %s does not point to the object", u)
+	}
+	if !strings.Contains(u, "X-Amz-Expires=60") {
+		t.Fatalf("Presigned URL %s has the wrong expiry", u)
+	}
+	if !strings.Contains(u, "response-content-type=text%2Fplain") {
+		t.Fatalf("Presigned URL %s does not set the content type", u)
+	}
+}
+
+func serveFile(t *testing.T, b S3Backend, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/selif/range.txt", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Etag", "\"abc\"")
+	err := b.ServeFile("range.txt", w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestServeFileRanges(t *testing.T) {
+	b, _, done := newTestBackend(t)
+	defer done()
+
+	_, err := b.Put("range.txt", strings.NewReader("0123456789"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveFile(t, b, nil)
+	if w.Code != 200 || w.Body.String() != "0123456789" {
+		t.Fatalf("Full request returned %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Last-Modified") == "" {
+		t.Fatal("Last-Modified was not set")
+	}
+	if w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatal("Accept-Ranges was not set")
+	}
+
+	w = serveFile(t, b, http.Header{"Range": {"bytes=2-5"}})
+	if w.Code != 206 || w.Body.String() != "2345" {
+		t.Fatalf("Range request returned %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Fatalf("Wrong Content-Range %s", w.Header().Get("Content-Range"))
+	}
+	if w.Header().Get("Content-Length") != "4" {
+		t.Fatalf("Wrong Content-Length %s", w.Header().Get("Content-Length"))
+	}
+
+	w = serveFile(t, b, http.Header{"Range": {"bytes=-3"}})
+	if w.Code != 206 || w.Body.String() != "789" {
+		t.Fatalf("Suffix range request returned %d %q", w.Code, w.Body.String())
+	}
+
+	w = serveFile(t, b, http.Header{"Range": {"bytes=0-1,8-9"}})
+	if w.Code != 206 {
+		t.Fatalf("Multi-range request returned %d", w.Code)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("Multi-range request returned %s", w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "Content-Range: bytes 0-1/10\r\n") ||
+		!strings.Contains(body, "\r\n\r\n01\r\n") ||
+		!strings.Contains(body, "Content-Range: bytes 8-9/10\r\n") ||
+		!strings.Contains(body, "\r\n\r\n89\r\n") {
+		t.Fatalf("Multi-range request returned %q", body)
+	}
+
+	w = serveFile(t, b, http.Header{"Range": {"bytes=20-30"}})
+	if w.Code != 416 {
+		t.Fatalf("Unsatisfiable range returned %d", w.Code)
+	}
+	if w.Header().Get("Content-Range") != "bytes */10" {
+		t.Fatalf("Wrong Content-Range %s", w.Header().Get("Content-Range"))
+	}
+
+	w = serveFile(t, b, http.Header{"Range": {"bytes=2-5"}, "If-Range": {"\"abc\""}})
+	if w.Code != 206 || w.Body.String() != "2345" {
+		t.Fatalf("Matching If-Range returned %d %q", w.Code, w.Body.String())
+	}
+
+	w = serveFile(t, b, http.Header{"Range": {"bytes=2-5"}, "If-Range": {"\"other\""}})
+	if w.Code != 200 || w.Body.String() != "0123456789" {
+		t.Fatalf("Stale If-Range returned %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestServeFileNotFound(t *testing.T) {
+	b, _, done := newTestBackend(t)
+	defer done()
+
+	w := httptest.NewRecorder()
+	err := b.ServeFile("missing.txt", w, httptest.NewRequest("GET", "/selif/missing.txt", nil))
+	if err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr, got %v", err)
+	}
+}
@@ -12,7 +12,10 @@ type StorageBackend interface {
 	Exists(key string) (bool, error)
 	Head(key string) (Metadata, error)
 	Get(key string) (Metadata, io.ReadCloser, error)
-	Put(key string, r io.Reader, expiry time.Time, deleteKey, accessKey string) (Metadata, error)
+	// Put stores the file read from r with the metadata given by the
+	// caller, such as its expiry and keys. Its size and sha256sum are
+	// computed as it is stored, and so is its mimetype unless one is given.
+	Put(key string, r io.Reader, m Metadata) (Metadata, error)
 	PutMetadata(key string, m Metadata) error
 	ServeFile(key string, w http.ResponseWriter, r *http.Request) error
 	Size(key string) (int64, error)
@@ -20,7 +23,23 @@ type StorageBackend interface {
 
 type MetaStorageBackend interface {
 	StorageBackend
-	List() ([]string, error)
+	// List calls fn for every stored key, fetching them as it goes rather
+	// than all at once. Listing stops at the first error returned by fn,
+	// which is then returned by List.
+	List(fn func(key string) error) error
+}
+
+// PresignedStorageBackend is implemented by backends that can hand out
+// short-lived URLs from which clients download a file directly, bypassing
+// linx-server. The response is served with the given content type.
+type PresignedStorageBackend interface {
+	PresignURL(key, mimetype string, expiry time.Duration) (string, error)
+}
+
+// ExpiryIndexedBackend is implemented by backends that can find expired
+// files without reading the metadata of every file.
+type ExpiryIndexedBackend interface {
+	ListExpired(before time.Time, fn func(key string) error) error
 }
 
 var NotFoundErr = errors.New("File not found.")
@@ -0,0 +1,340 @@
+package tiered
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/minio/sha256-simd"
+)
+
+var errMigrationMismatch = errors.New("tiered: migrated file does not match the original")
+
+// HotBackend is what the hot tier has to provide on top of listing: when a
+// file was stored, so that it can be migrated once it is old enough.
+type HotBackend interface {
+	backends.MetaStorageBackend
+	ModTime(key string) (time.Time, error)
+}
+
+type TieredOptions struct {
+	// Uploads larger than this many bytes are stored in the cold tier
+	// straight away
+	MaxHotSize int64
+
+	// Files are migrated to the cold tier once they were stored this
+	// long ago, or 0 to not migrate by age
+	MaxAge time.Duration
+
+	// Files are migrated to the cold tier once they haven't been
+	// downloaded for this long, or 0 to not migrate by access
+	MaxIdle time.Duration
+}
+
+// TieredBackend stores small and recently used files in a hot backend,
+// typically local disk, and everything else in a cold one, typically S3.
+// Callers don't need to know which tier holds a file.
+type TieredBackend struct {
+	hot  HotBackend
+	cold backends.MetaStorageBackend
+	o    TieredOptions
+
+	mu       *sync.Mutex
+	accessed map[string]time.Time
+	locks    map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func NewTieredBackend(hot HotBackend, cold backends.MetaStorageBackend, o TieredOptions) TieredBackend {
+	return TieredBackend{
+		hot:      hot,
+		cold:     cold,
+		o:        o,
+		mu:       &sync.Mutex{},
+		accessed: make(map[string]time.Time),
+		locks:    make(map[string]*keyLock),
+	}
+}
+
+// lock serializes changes to key, so that a migration never races with an
+// upload or deletion of the same file. It returns the matching unlock.
+func (b TieredBackend) lock(key string) func() {
+	b.mu.Lock()
+	l, ok := b.locks[key]
+	if !ok {
+		l = &keyLock{}
+		b.locks[key] = l
+	}
+	l.refs++
+	b.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		b.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(b.locks, key)
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b TieredBackend) touch(key string) {
+	b.mu.Lock()
+	b.accessed[key] = time.Now()
+	b.mu.Unlock()
+}
+
+func (b TieredBackend) forget(key string) {
+	b.mu.Lock()
+	delete(b.accessed, key)
+	b.mu.Unlock()
+}
+
+// locate returns the tier holding key along with its metadata.
+func (b TieredBackend) locate(key string) (backends.MetaStorageBackend, backends.Metadata, error) {
+	m, err := b.hot.Head(key)
+	if err == nil {
+		return b.hot, m, nil
+	} else if err != backends.NotFoundErr {
+		return nil, m, err
+	}
+
+	m, err = b.cold.Head(key)
+	if err != nil {
+		return nil, m, err
+	}
+	return b.cold, m, nil
+}
+
+func (b TieredBackend) Delete(key string) error {
+	defer b.lock(key)()
+
+	tier, _, err := b.locate(key)
+	if err == backends.BadMetadata {
+		// still remove what is left of the file
+		tier = b.hot
+	} else if err != nil {
+		return err
+	}
+
+	b.forget(key)
+	return tier.Delete(key)
+}
+
+func (b TieredBackend) Exists(key string) (bool, error) {
+	if ok, _ := b.hot.Exists(key); ok {
+		return true, nil
+	}
+	return b.cold.Exists(key)
+}
+
+func (b TieredBackend) Head(key string) (backends.Metadata, error) {
+	_, m, err := b.locate(key)
+	return m, err
+}
+
+func (b TieredBackend) Get(key string) (m backends.Metadata, r io.ReadCloser, err error) {
+	m, r, err = b.hot.Get(key)
+	if err == nil {
+		b.touch(key)
+		return
+	} else if err != backends.NotFoundErr {
+		return
+	}
+
+	return b.cold.Get(key)
+}
+
+func (b TieredBackend) Put(key string, r io.Reader, meta backends.Metadata) (m backends.Metadata, err error) {
+	// Only as much as fits in the hot tier is spooled to disk before
+	// deciding where the upload goes
+	spool, err := ioutil.TempFile("", "linx-tiered-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	n, err := io.CopyN(spool, r, b.o.MaxHotSize+1)
+	if err != nil && err != io.EOF {
+		return
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	var tier, other backends.MetaStorageBackend = b.hot, b.cold
+	if n > b.o.MaxHotSize {
+		tier, other = b.cold, b.hot
+	}
+
+	defer b.lock(key)()
+
+	m, err = tier.Put(key, io.MultiReader(spool, r), meta)
+	if err != nil {
+		return
+	}
+
+	// drop an older version of the file from the other tier
+	if _, err := other.Head(key); err == nil {
+		other.Delete(key)
+	}
+	b.forget(key)
+
+	return
+}
+
+func (b TieredBackend) PutMetadata(key string, m backends.Metadata) error {
+	defer b.lock(key)()
+
+	tier, _, err := b.locate(key)
+	if err != nil {
+		return err
+	}
+	return tier.PutMetadata(key, m)
+}
+
+func (b TieredBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) error {
+	err := b.hot.ServeFile(key, w, r)
+	if err == nil {
+		b.touch(key)
+		return nil
+	} else if err != backends.NotFoundErr {
+		return err
+	}
+
+	return b.cold.ServeFile(key, w, r)
+}
+
+func (b TieredBackend) Size(key string) (int64, error) {
+	tier, _, err := b.locate(key)
+	if err != nil {
+		return 0, err
+	}
+	return tier.Size(key)
+}
+
+// List lists the keys of both tiers, each key only once even while it is
+// being migrated.
+func (b TieredBackend) List(fn func(key string) error) error {
+	err := b.hot.List(fn)
+	if err != nil {
+		return err
+	}
+
+	return b.cold.List(func(key string) error {
+		if _, err := b.hot.Head(key); err == nil {
+			return nil
+		}
+		return fn(key)
+	})
+}
+
+// due reports whether key should be moved to the cold tier.
+func (b TieredBackend) due(key string) (bool, error) {
+	stored, err := b.hot.ModTime(key)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if b.o.MaxAge > 0 && now.Sub(stored) > b.o.MaxAge {
+		return true, nil
+	}
+
+	if b.o.MaxIdle > 0 {
+		b.mu.Lock()
+		accessed, ok := b.accessed[key]
+		b.mu.Unlock()
+		if !ok || accessed.Before(stored) {
+			accessed = stored
+		}
+		if now.Sub(accessed) > b.o.MaxIdle {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// migrate moves key from the hot to the cold tier. The hot copy is only
+// removed once the cold one is known to be complete.
+func (b TieredBackend) migrate(key string) error {
+	defer b.lock(key)()
+
+	m, r, err := b.hot.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// The stored checksum can't be relied on, e.g. when the files are
+	// encrypted, so compare against what was actually read
+	hasher := sha256.New()
+	cm, err := b.cold.Put(key, io.TeeReader(r, hasher), m)
+	if err != nil {
+		return err
+	}
+	if cm.Sha256sum != hex.EncodeToString(hasher.Sum(nil)) {
+		b.cold.Delete(key)
+		return errMigrationMismatch
+	}
+
+	// carry over anything else set since the upload
+	err = b.cold.PutMetadata(key, m)
+	if err != nil {
+		return err
+	}
+
+	b.forget(key)
+	return b.hot.Delete(key)
+}
+
+// Migrate moves every file that is due from the hot to the cold tier.
+func (b TieredBackend) Migrate(noLogs bool) error {
+	return b.hot.List(func(key string) error {
+		ok, err := b.due(key)
+		if err != nil || !ok {
+			return nil
+		}
+
+		err = b.migrate(key)
+		if err == backends.NotFoundErr {
+			// deleted in the meantime
+			return nil
+		} else if err != nil {
+			// try again on the next run
+			log.Printf("Failed to migrate %s: %v", key, err)
+			return nil
+		}
+
+		if !noLogs {
+			log.Printf("Migrated %s", key)
+		}
+		return nil
+	})
+}
+
+func (b TieredBackend) PeriodicMigrate(interval time.Duration, noLogs bool) {
+	c := time.Tick(interval)
+	for range c {
+		err := b.Migrate(noLogs)
+		if err != nil {
+			log.Printf("Migration failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package tiered
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/memory"
+)
+
+func newTestBackend(o TieredOptions) (TieredBackend, *memory.MemoryBackend, *memory.MemoryBackend) {
+	hot := memory.NewMemoryBackend(0)
+	cold := memory.NewMemoryBackend(0)
+	return NewTieredBackend(hot, cold, o), hot, cold
+}
+
+func listKeys(t *testing.T, b backends.MetaStorageBackend) []string {
+	var keys []string
+	err := b.List(func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestPutRoutesBySize(t *testing.T) {
+	b, hot, cold := newTestBackend(TieredOptions{MaxHotSize: 5})
+
+	_, err := b.Put("small.txt", strings.NewReader("small"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := b.Put("large.txt", strings.NewReader("larger file"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != 11 {
+		t.Fatalf("Wrong size %d for large.txt", m.Size)
+	}
+
+	if ok, _ := hot.Exists("small.txt"); !ok {
+		t.Fatal("Small file was not stored in the hot tier")
+	}
+	if ok, _ := cold.Exists("large.txt"); !ok {
+		t.Fatal("Large file was not stored in the cold tier")
+	}
+
+	_, r, err := b.Get("large.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "larger file" {
+		t.Fatalf("Got %q from the cold tier", data)
+	}
+
+	// overwriting moves the file between tiers
+	_, err = b.Put("large.txt", strings.NewReader("tiny"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := cold.Exists("large.txt"); ok {
+		t.Fatal("Old version was left in the cold tier")
+	}
+
+	if keys := listKeys(t, b); strings.Join(keys, ",") != "large.txt,small.txt" {
+		t.Fatalf("Listed %v", keys)
+	}
+
+	for _, key := range []string{"small.txt", "large.txt"} {
+		err = b.Delete(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = b.Head(key); err != backends.NotFoundErr {
+			t.Fatalf("Expected NotFoundErr after deleting %s, got %v", key, err)
+		}
+	}
+}
+
+func TestPutLeavesNoSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linx-tiered-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", dir)
+
+	b, _, _ := newTestBackend(TieredOptions{MaxHotSize: 5})
+	for _, content := range []string{"small", "larger file"} {
+		_, err := b.Put("test.txt", strings.NewReader(content), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 0 {
+		t.Fatalf("%d spooled uploads were left behind", len(infos))
+	}
+}
+
+func TestMigrateByAge(t *testing.T) {
+	b, hot, cold := newTestBackend(TieredOptions{MaxHotSize: 1024, MaxAge: time.Nanosecond})
+
+	_, err := b.Put("old.txt", strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey", AccessKey: "acckey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := b.Head("old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Mimetype = "text/x-custom"
+	err = b.PutMetadata("old.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+	err = b.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := hot.Exists("old.txt"); ok {
+		t.Fatal("Migrated file was left in the hot tier")
+	}
+	cm, err := cold.Head("old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.AccessKey != "acckey" || cm.Mimetype != "text/x-custom" || cm.Sha256sum != m.Sha256sum {
+		t.Fatalf("Metadata was not carried over: %+v", cm)
+	}
+
+	w := httptest.NewRecorder()
+	err = b.ServeFile("old.txt", w, httptest.NewRequest("GET", "/selif/old.txt", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.String() != "File content" {
+		t.Fatalf("Served %q after migration", w.Body.String())
+	}
+}
+
+func TestMigrateByAccess(t *testing.T) {
+	b, hot, _ := newTestBackend(TieredOptions{MaxHotSize: 1024, MaxIdle: 20 * time.Millisecond})
+
+	for _, key := range []string{"used.txt", "idle.txt"} {
+		_, err := b.Put(key, strings.NewReader("File content"), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	_, r, err := b.Get("used.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	err = b.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := hot.Exists("used.txt"); !ok {
+		t.Fatal("Recently downloaded file was migrated")
+	}
+	if ok, _ := hot.Exists("idle.txt"); ok {
+		t.Fatal("Idle file was not migrated")
+	}
+	if keys := listKeys(t, b); strings.Join(keys, ",") != "idle.txt,used.txt" {
+		t.Fatalf("Listed %v", keys)
+	}
+}
@@ -74,3 +74,31 @@ cd ..
 cd linx-cleanup
 build_binary "../binaries/""$version""/linx-cleanup-v""$version""_"
 cd ..
+
+cd linx-dedup
+build_binary "../binaries/""$version""/linx-dedup-v""$version""_"
+cd ..
+
+cd linx-reshard
+build_binary "../binaries/""$version""/linx-reshard-v""$version""_"
+cd ..
+
+cd linx-fsck
+build_binary "../binaries/""$version""/linx-fsck-v""$version""_"
+cd ..
+
+cd linx-resync
+build_binary "../binaries/""$version""/linx-resync-v""$version""_"
+cd ..
+
+cd linx-reencrypt
+build_binary "../binaries/""$version""/linx-reencrypt-v""$version""_"
+cd ..
+
+cd linx-migrate
+build_binary "../binaries/""$version""/linx-migrate-v""$version""_"
+cd ..
+
+cd linx-index
+build_binary "../binaries/""$version""/linx-index-v""$version""_"
+cd ..
@@ -4,24 +4,31 @@ import (
 	"log"
 	"time"
 
-	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends"
 	"github.com/andreimarcu/linx-server/expiry"
 )
 
-func Cleanup(filesDir string, metaDir string, noLogs bool) {
-	fileBackend := localfs.NewLocalfsBackend(metaDir, filesDir)
-
-	files, err := fileBackend.List()
-	if err != nil {
-		panic(err)
+func Cleanup(fileBackend backends.MetaStorageBackend, noLogs bool) error {
+	if indexed, ok := fileBackend.(backends.ExpiryIndexedBackend); ok {
+		return indexed.ListExpired(time.Now(), func(filename string) error {
+			if !noLogs {
+				log.Printf("Delete %s", filename)
+			}
+			fileBackend.Delete(filename)
+			return nil
+		})
 	}
 
-	for _, filename := range files {
+	return fileBackend.List(func(filename string) error {
 		metadata, err := fileBackend.Head(filename)
-		if err != nil {
+		if err == backends.NotFoundErr || err == backends.BadMetadata {
 			if !noLogs {
 				log.Printf("Failed to find metadata for %s", filename)
 			}
+		} else if err != nil {
+			// Possibly a transient error, try again next time
+			log.Printf("Failed to read metadata for %s: %v", filename, err)
+			return nil
 		}
 
 		if expiry.IsTsExpired(metadata.Expiry) {
@@ -30,13 +37,18 @@ func Cleanup(filesDir string, metaDir string, noLogs bool) {
 			}
 			fileBackend.Delete(filename)
 		}
-	}
+
+		return nil
+	})
 }
 
-func PeriodicCleanup(minutes time.Duration, filesDir string, metaDir string, noLogs bool) {
+func PeriodicCleanup(minutes time.Duration, fileBackend backends.MetaStorageBackend, noLogs bool) {
 	c := time.Tick(minutes)
 	for range c {
-		Cleanup(filesDir, metaDir, noLogs)
+		err := Cleanup(fileBackend, noLogs)
+		if err != nil {
+			log.Printf("Cleanup failed: %v", err)
+		}
 	}
 
 }
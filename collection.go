@@ -0,0 +1,342 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/dustin/go-humanize"
+	"github.com/flosch/pongo2"
+	"github.com/zenazn/goji/web"
+)
+
+// Collections group files uploaded together under one name. They are
+// stored as any other file, holding the list of files they reference, and
+// are told apart by their mimetype, which no upload is ever detected as.
+// All files of a collection share its delete key, access key and expiry.
+
+const collectionMimetype = "application/x-linx-collection+json"
+const collectionExtension = "collection"
+
+type Collection struct {
+	Files []CollectionFile `json:"files"`
+}
+
+type CollectionFile struct {
+	Filename string `json:"filename"` // Name of the file in storage
+	Name     string `json:"name"`     // Name the file was uploaded with
+}
+
+// A file of a collection, as it is displayed
+type collectionEntry struct {
+	CollectionFile
+	Mimetype  string
+	Size      int64
+	SizeHuman string
+	Limited   bool // has a download limit, so can't be previewed
+
+	// for pastes, when small enough to be displayed
+	LangHl   string
+	Contents string
+}
+
+func (e collectionEntry) isText() bool {
+	extension := strings.TrimPrefix(filepath.Ext(e.Filename), ".")
+	return strings.HasPrefix(e.Mimetype, "text/") || supportedBinExtension(extension)
+}
+
+func isCollection(metadata backends.Metadata) bool {
+	return metadata.Mimetype == collectionMimetype
+}
+
+// Store a collection referencing the given uploads, which must have been
+// made with the same upload request
+func processCollection(uploads []Upload, names []string, upReq UploadRequest) (upload Upload, err error) {
+	var collection Collection
+	for i, u := range uploads {
+		collection.Files = append(collection.Files, CollectionFile{
+			Filename: u.Filename,
+			Name:     names[i],
+		})
+	}
+
+	js, err := json.Marshal(collection)
+	if err != nil {
+		return
+	}
+
+	// the list of files isn't held to the size limit, it is bounded by
+	// the number of files instead
+	upReq.src = bytes.NewReader(js)
+	upReq.size = 0
+	upReq.filename = "." + collectionExtension
+	upReq.randomBarename = true
+	upReq.deleteKey = uploads[0].Metadata.DeleteKey
+	upReq.maxDownloads = 0
+	upReq.mimetype = collectionMimetype
+
+	// keep the expiry of the files, which can be later than the time the
+	// collection is stored at
+	upReq.expires = uploads[0].Metadata.Expiry
+	upReq.deadline = uploads[0].Metadata.Deadline
+
+	return processUpload(upReq)
+}
+
+func readCollection(fileName string) (collection Collection, err error) {
+	_, reader, err := storageBackend.Get(fileName)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	err = json.NewDecoder(reader).Decode(&collection)
+	if err != nil {
+		err = backends.BadMetadata
+	}
+	return
+}
+
+// Check that a file of a collection still exists and still belongs to it.
+// Files can be deleted on their own, and another file uploaded under the
+// same name must not be taken for them.
+func checkMember(f CollectionFile, collection backends.Metadata) (metadata backends.Metadata, err error) {
+	metadata, err = checkFile(f.Filename)
+	if err != nil {
+		return
+	}
+
+	if metadata.DeleteKey != collection.DeleteKey || metadata.AccessKey != collection.AccessKey {
+		err = backends.NotFoundErr
+	}
+	return
+}
+
+// The files of a collection which still exist, which are kept as long as
+// the collection is displayed
+func collectionEntries(collection Collection, metadata backends.Metadata) (entries []collectionEntry) {
+	for _, f := range collection.Files {
+		metadata, err := checkMember(f, metadata)
+		if err != nil {
+			continue
+		}
+		slideExpiry(f.Filename, metadata)
+
+		entries = append(entries, collectionEntry{
+			CollectionFile: f,
+			Mimetype:       metadata.Mimetype,
+			Size:           metadata.Size,
+			SizeHuman:      humanize.Bytes(uint64(metadata.Size)),
+			Limited:        metadata.MaxDownloads > 0,
+		})
+	}
+	return
+}
+
+func collectionDisplayHandler(c web.C, w http.ResponseWriter, r *http.Request, fileName string, metadata backends.Metadata) {
+	collection, err := readCollection(fileName)
+	if err != nil {
+		oopsHandler(c, w, r, RespAUTO, "Corrupt collection.")
+		return
+	}
+	entries := collectionEntries(collection, metadata)
+
+	// the files are displayed along with the collection, let them through
+	if metadata.AccessKey != "" {
+		var expiry time.Time
+		if Config.accessKeyCookieExpiry != 0 {
+			expiry = time.Now().Add(time.Duration(Config.accessKeyCookieExpiry) * time.Second)
+		}
+		for _, entry := range entries {
+			setAccessKeyCookies(w, getSiteURL(r), entry.Filename, metadata.AccessKey, expiry)
+		}
+	}
+
+	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
+		files := []map[string]string{}
+		for _, entry := range entries {
+			files = append(files, map[string]string{
+				"filename":   entry.Filename,
+				"name":       entry.Name,
+				"url":        getSiteURL(r) + entry.Filename,
+				"direct_url": getSiteURL(r) + Config.selifPath + entry.Filename,
+				"mimetype":   entry.Mimetype,
+				"size":       strconv.FormatInt(entry.Size, 10),
+			})
+		}
+
+		js, _ := json.Marshal(map[string]interface{}{
+			"filename": fileName,
+			"expiry":   strconv.FormatInt(metadata.Expiry.Unix(), 10),
+			"files":    files,
+		})
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Write(js)
+		return
+	}
+
+	var expiryHuman string
+	if metadata.Expiry != expiry.NeverExpire {
+		expiryHuman = humanize.RelTime(time.Now(), metadata.Expiry, "", "")
+	}
+
+	// a gallery if all files are images, a paste if they are all text, and
+	// a list otherwise
+	gallery := len(entries) > 0
+	paste := len(entries) > 0
+	var size int64
+	for _, entry := range entries {
+		gallery = gallery && strings.HasPrefix(entry.Mimetype, "image/") && !entry.Limited
+		paste = paste && entry.isText() && !entry.Limited
+		size += entry.Size
+	}
+
+	if paste {
+		for i, entry := range entries {
+			entries[i].LangHl = extensionToHlLang(strings.TrimPrefix(filepath.Ext(entry.Filename), "."))
+			if entry.Size >= maxDisplayFileSizeBytes {
+				continue
+			}
+
+			_, reader, err := storageBackend.Get(entry.Filename)
+			if err != nil {
+				continue
+			}
+			contents, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err == nil {
+				entries[i].Contents = string(contents)
+			}
+		}
+	}
+
+	err = renderTemplate(Templates["display/collection.html"], pongo2.Context{
+		"filename": fileName,
+		"entries":  entries,
+		"gallery":  gallery,
+		"paste":    paste,
+		"size":     humanize.Bytes(uint64(size)),
+		"expiry":   expiryHuman,
+	}, r, w)
+	if err != nil {
+		oopsHandler(c, w, r, RespHTML, "")
+	}
+}
+
+// Serve the files of a collection as a tar archive
+func collectionTarballHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	fileName := c.URLParams["name"]
+
+	metadata, err := checkFile(fileName)
+	if err == backends.NotFoundErr || (err == nil && !isCollection(metadata)) {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, RespAUTO, "Corrupt metadata.")
+		return
+	}
+
+	if _, err := checkAccessKey(r, &metadata); err != nil {
+		unauthorizedHandler(c, w, r)
+		return
+	}
+
+	if isHotlinked(r) {
+		http.Redirect(w, r, Config.sitePath+fileName, 303)
+		return
+	}
+
+	collection, err := readCollection(fileName)
+	if err != nil {
+		oopsHandler(c, w, r, RespAUTO, "Corrupt collection.")
+		return
+	}
+	slideExpiry(fileName, metadata)
+
+	barename, _ := barePlusExt(fileName)
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar"`, barename))
+
+	tw := tar.NewWriter(w)
+	seen := make(map[string]bool)
+	for _, f := range collection.Files {
+		m, err := checkMember(f, metadata)
+		if err != nil {
+			continue
+		}
+		slideExpiry(f.Filename, m)
+		counted, last := m.MaxDownloads > 0, false
+		if counted {
+			last, err = countDownload(f.Filename)
+			if err != nil {
+				continue
+			}
+		}
+
+		m, reader, err := storageBackend.Get(f.Filename)
+		if err != nil {
+			if counted {
+				uncountDownload(f.Filename)
+			}
+			continue
+		}
+		if last {
+			defer storageBackend.Delete(f.Filename)
+		}
+
+		// names given by uploaders can't be trusted to be unique, nor to
+		// stay within the archive
+		name := path.Base(strings.Replace(f.Name, "\\", "/", -1))
+		if name == "." || name == "/" || seen[name] {
+			name = f.Filename
+		}
+		seen[name] = true
+
+		err = tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    m.Size,
+			ModTime: time.Now(),
+		})
+		if err == nil {
+			_, err = io.Copy(tw, reader)
+		}
+		reader.Close()
+		if err != nil {
+			// the response has started, all we can do is cut it short
+			log.Printf("Failed to write %s to the tarball of %s: %v", f.Filename, fileName, err)
+			return
+		}
+	}
+	tw.Close()
+}
+
+// Delete a collection along with its files
+func deleteCollection(fileName string, deleteKey string) error {
+	collection, err := readCollection(fileName)
+	if err != nil && err != backends.BadMetadata {
+		return err
+	}
+
+	for _, f := range collection.Files {
+		metadata, err := storageBackend.Head(f.Filename)
+		if err != nil || metadata.DeleteKey != deleteKey {
+			continue
+		}
+		storageBackend.Delete(f.Filename)
+	}
+
+	return storageBackend.Delete(fileName)
+}
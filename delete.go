@@ -24,7 +24,11 @@ func deleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 
 	if metadata.DeleteKey == requestKey {
-		err := storageBackend.Delete(filename)
+		if isCollection(metadata) {
+			err = deleteCollection(filename, requestKey)
+		} else {
+			err = storageBackend.Delete(filename)
+		}
 		if err != nil {
 			oopsHandler(c, w, r, RespPLAIN, "Could not delete")
 			return
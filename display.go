@@ -31,22 +31,37 @@ func fileDisplayHandler(c web.C, w http.ResponseWriter, r *http.Request, fileNam
 
 	extension := strings.TrimPrefix(filepath.Ext(fileName), ".")
 
+	if isCollection(metadata) {
+		collectionDisplayHandler(c, w, r, fileName, metadata)
+		return
+	}
+
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		js, _ := json.Marshal(map[string]string{
+		info := map[string]string{
 			"filename":   fileName,
 			"direct_url": getSiteURL(r) + Config.selifPath + fileName,
 			"expiry":     strconv.FormatInt(metadata.Expiry.Unix(), 10),
 			"size":       strconv.FormatInt(metadata.Size, 10),
 			"mimetype":   metadata.Mimetype,
 			"sha256sum":  metadata.Sha256sum,
-		})
+		}
+		if metadata.MaxDownloads > 0 {
+			info["downloads_left"] = downloadsLeft(metadata)
+		}
+
+		js, _ := json.Marshal(info)
 		w.Write(js)
 		return
 	}
 
 	var tpl *pongo2.Template
 
-	if strings.HasPrefix(metadata.Mimetype, "image/") {
+	if metadata.MaxDownloads > 0 {
+		// previews would either count as downloads or show the file
+		// without counting, only link to it
+		tpl = Templates["display/file.html"]
+
+	} else if strings.HasPrefix(metadata.Mimetype, "image/") {
 		tpl = Templates["display/image.html"]
 
 	} else if strings.HasPrefix(metadata.Mimetype, "video/") {
@@ -123,6 +138,7 @@ func fileDisplayHandler(c web.C, w http.ResponseWriter, r *http.Request, fileNam
 		"lines":       lines,
 		"files":       metadata.ArchiveFiles,
 		"siteurl":     strings.TrimSuffix(getSiteURL(r), "/"),
+		"downloads":   downloadsLeft(metadata),
 	}, r, w)
 
 	if err != nil {
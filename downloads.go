@@ -0,0 +1,84 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Files uploaded with a download limit have their downloads counted in
+// their metadata, and are deleted once the limit is reached. Counting is
+// serialized per file so that concurrent downloads can't go over the
+// limit, which only holds for requests handled by the same instance.
+
+var metadataLocks [64]sync.Mutex
+
+// The lock serializing updates to the metadata of a file made as it is
+// accessed
+func metadataLock(fileName string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(fileName))
+	return &metadataLocks[h.Sum32()%uint32(len(metadataLocks))]
+}
+
+// Count a download of a file. It fails with NotFoundErr if the limit of the
+// file was already reached, and reports whether this is the last download
+// allowed, after which the caller must delete the file.
+func countDownload(fileName string) (last bool, err error) {
+	lock := metadataLock(fileName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	metadata, err := storageBackend.Head(fileName)
+	if err != nil || metadata.MaxDownloads == 0 {
+		return
+	}
+
+	// the last download is still being served
+	if metadata.Downloads >= metadata.MaxDownloads {
+		return false, backends.NotFoundErr
+	}
+
+	metadata.Downloads++
+	err = storageBackend.PutMetadata(fileName, metadata)
+	return metadata.Downloads >= metadata.MaxDownloads, err
+}
+
+// Take back a download counted for a file which could then not be served
+func uncountDownload(fileName string) {
+	lock := metadataLock(fileName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	metadata, err := storageBackend.Head(fileName)
+	if err != nil || metadata.Downloads == 0 {
+		return
+	}
+
+	metadata.Downloads--
+	err = storageBackend.PutMetadata(fileName, metadata)
+	if err != nil {
+		log.Printf("Failed to take back a download of %s: %v", fileName, err)
+	}
+}
+
+// How many more times a file can be downloaded, as displayed, which is
+// empty if there is no limit
+func downloadsLeft(metadata backends.Metadata) string {
+	if metadata.MaxDownloads == 0 {
+		return ""
+	}
+	return strconv.FormatInt(metadata.MaxDownloads-metadata.Downloads, 10)
+}
+
+// Parse a download limit, anything but a positive integer meaning none
+func parseMaxDownloads(s string) int64 {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
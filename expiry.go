@@ -1,8 +1,10 @@
 package main
 
 import (
+	"log"
 	"time"
 
+	"github.com/andreimarcu/linx-server/backends"
 	"github.com/andreimarcu/linx-server/expiry"
 	"github.com/dustin/go-humanize"
 )
@@ -67,3 +69,71 @@ func listExpirationTimes() []ExpirationTime {
 
 	return expiryList
 }
+
+// With sliding expiry, files which expire are kept for a while after they
+// were last downloaded or displayed, and at most until the expiry they were
+// uploaded with
+func slidingExpiryWindow() time.Duration {
+	window := Config.slidingExpiry
+	if Config.maxExpiry > 0 && window > Config.maxExpiry {
+		window = Config.maxExpiry
+	}
+	return time.Duration(window) * time.Second
+}
+
+// The expiry of a file uploaded now to expire after d, and with sliding
+// expiry the deadline it can't be pushed back past
+func uploadExpiry(d time.Duration) (fileExpiry time.Time, deadline time.Time) {
+	fileExpiry = expiryTime(d)
+	if Config.slidingExpiry == 0 || d == 0 {
+		return
+	}
+
+	deadline = fileExpiry
+	if idle := time.Now().Add(slidingExpiryWindow()); idle.Before(fileExpiry) {
+		fileExpiry = idle
+	}
+	return
+}
+
+// Whether the expiry of a file should be moved to newExpiry. To not rewrite
+// its metadata on every access, it is only moved by a tenth of the sliding
+// expiry window at least, or up to its deadline.
+func shouldSlide(metadata backends.Metadata, newExpiry time.Time, window time.Duration) bool {
+	moved := newExpiry.Sub(metadata.Expiry)
+	return moved >= window/10 || (moved >= time.Second && newExpiry.Equal(metadata.Deadline))
+}
+
+// Push the expiry of a file back after it was accessed, up to its deadline.
+// On S3 this rewrites the object, which changes the Last-Modified date that
+// resumed downloads are checked against, so callers don't slide the expiry
+// for range requests.
+func slideExpiry(fileName string, metadata backends.Metadata) {
+	if Config.slidingExpiry == 0 || metadata.Deadline.IsZero() {
+		return
+	}
+
+	window := slidingExpiryWindow()
+	newExpiry := time.Now().Add(window)
+	if newExpiry.After(metadata.Deadline) {
+		newExpiry = metadata.Deadline
+	}
+	if !shouldSlide(metadata, newExpiry, window) {
+		return
+	}
+
+	lock := metadataLock(fileName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	metadata, err := storageBackend.Head(fileName)
+	if err != nil || !shouldSlide(metadata, newExpiry, window) {
+		return
+	}
+
+	metadata.Expiry = newExpiry
+	err = storageBackend.PutMetadata(fileName, metadata)
+	if err != nil {
+		log.Printf("Failed to extend expiry of %s: %v", fileName, err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -36,39 +37,94 @@ func fileServeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !Config.allowHotlink {
-		referer := r.Header.Get("Referer")
-		u, _ := url.Parse(referer)
-		p, _ := url.Parse(getSiteURL(r))
-		if referer != "" && !sameOrigin(u, p) {
-			http.Redirect(w, r, Config.sitePath+fileName, 303)
-			return
+	if isHotlinked(r) {
+		http.Redirect(w, r, Config.sitePath+fileName, 303)
+		return
+	}
+
+	// presigned URLs can be reused, which would bypass the download limit
+	if Config.s3Presign && r.Method != "HEAD" && metadata.MaxDownloads == 0 && !needsSecurityHeaders(metadata.Mimetype) {
+		if p, ok := storageBackend.(backends.PresignedStorageBackend); ok {
+			expiry := time.Duration(Config.s3PresignExpiry) * time.Second
+			u, err := p.PresignURL(fileName, metadata.Mimetype, expiry)
+			if err == nil {
+				if r.Header.Get("Range") == "" {
+					slideExpiry(fileName, metadata)
+				}
+				w.Header().Set("Cache-Control", "private, no-store")
+				http.Redirect(w, r, u, 302)
+				return
+			}
+			// fall back to proxying the file
+			log.Printf("Failed to presign %s: %v", fileName, err)
 		}
 	}
 
 	w.Header().Set("Content-Security-Policy", Config.fileContentSecurityPolicy)
 	w.Header().Set("Referrer-Policy", Config.fileReferrerPolicy)
 
-	w.Header().Set("Content-Type", metadata.Mimetype)
-	w.Header().Set("Content-Length", strconv.FormatInt(metadata.Size, 10))
 	w.Header().Set("Etag", fmt.Sprintf("\"%s\"", metadata.Sha256sum))
-	w.Header().Set("Cache-Control", "public, no-cache")
+	if metadata.MaxDownloads > 0 {
+		w.Header().Set("Cache-Control", "private, no-store")
+	} else {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
 
 	modtime := time.Unix(0, 0)
 	if done := httputil.CheckPreconditions(w, r, modtime); done == true {
 		return
 	}
 
+	// the display page doesn't count as a download, only getting the file
+	// itself does, every time any of its bytes are sent
+	counted, last := false, false
+	if metadata.MaxDownloads > 0 && r.Method != "HEAD" {
+		last, err = countDownload(fileName)
+		if err == backends.NotFoundErr {
+			notFoundHandler(c, w, r)
+			return
+		} else if err != nil {
+			oopsHandler(c, w, r, RespAUTO, "Could not count download.")
+			return
+		}
+		counted = true
+	}
+
+	w.Header().Set("Content-Type", metadata.Mimetype)
+	w.Header().Set("Content-Length", strconv.FormatInt(metadata.Size, 10))
+
 	if r.Method != "HEAD" {
 
-		storageBackend.ServeFile(fileName, w, r)
+		err = storageBackend.ServeFile(fileName, w, r)
 		if err != nil {
+			if counted {
+				uncountDownload(fileName)
+			}
 			oopsHandler(c, w, r, RespAUTO, err.Error())
 			return
 		}
+
+		if last {
+			storageBackend.Delete(fileName)
+		} else if r.Header.Get("Range") == "" {
+			slideExpiry(fileName, metadata)
+		}
 	}
 }
 
+// Whether a file is requested from another site while hotlinking is not
+// allowed
+func isHotlinked(r *http.Request) bool {
+	if Config.allowHotlink {
+		return false
+	}
+
+	referer := r.Header.Get("Referer")
+	u, _ := url.Parse(referer)
+	p, _ := url.Parse(getSiteURL(r))
+	return referer != "" && !sameOrigin(u, p)
+}
+
 func staticHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	if path[len(path)-1:] == "/" {
@@ -93,6 +149,20 @@ func staticHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// needsSecurityHeaders reports whether a file may be rendered as active
+// content by browsers, and so must be served with our own headers
+func needsSecurityHeaders(mimetype string) bool {
+	mimetype = strings.ToLower(strings.TrimSpace(strings.Split(mimetype, ";")[0]))
+
+	switch mimetype {
+	case "text/html", "application/xhtml+xml", "image/svg+xml",
+		"text/xml", "application/xml", "text/javascript",
+		"application/javascript", "application/x-javascript", "application/pdf":
+		return true
+	}
+	return strings.HasSuffix(mimetype, "+xml")
+}
+
 func checkFile(filename string) (metadata backends.Metadata, err error) {
 	metadata, err = storageBackend.Head(filename)
 	if err != nil {
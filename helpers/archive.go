@@ -15,6 +15,15 @@ type ReadSeekerAt interface {
 	io.ReaderAt
 }
 
+// IsArchive reports whether ListArchiveFiles can list files of mimetype.
+func IsArchive(mimetype string) bool {
+	switch mimetype {
+	case "application/x-tar", "application/x-gzip", "application/x-bzip", "application/zip":
+		return true
+	}
+	return false
+}
+
 func ListArchiveFiles(mimetype string, size int64, r ReadSeekerAt) (files []string, err error) {
 	if mimetype == "application/x-tar" {
 		tReadr := tar.NewReader(r)
@@ -1,8 +1,8 @@
 package helpers
 
 import (
-	"bytes"
 	"encoding/hex"
+	"hash"
 	"io"
 	"unicode"
 
@@ -11,48 +11,76 @@ import (
 	"github.com/minio/sha256-simd"
 )
 
-func GenerateMetadata(r io.Reader) (m backends.Metadata, err error) {
-	// Since we don't have the ability to seek within a file, we can use a
-	// Buffer in combination with a TeeReader to keep a copy of the bytes
-	// we read when detecting the file type. These bytes are still needed
-	// to hash the file and determine its size and cannot be discarded.
-	var buf bytes.Buffer
-	teeReader := io.TeeReader(r, &buf)
-
-	// Get first 512 bytes for mimetype detection
-	header := make([]byte, 512)
-	headerlen, err := teeReader.Read(header)
-	if err != nil {
-		return
-	}
+// Number of leading bytes used for mimetype detection
+const sniffLen = 512
 
-	// Create a Hash and a MultiReader that includes the Buffer we created
-	// above along with the original Reader, which will have the rest of
-	// the file.
-	hasher := sha256.New()
-	multiReader := io.MultiReader(&buf, r)
+// MetadataHasher computes the size, sha256sum and mimetype of everything
+// written to it, so that metadata can be generated in the same pass that
+// stores a file.
+type MetadataHasher struct {
+	hasher hash.Hash
+	header []byte
+	size   int64
+}
 
-	// Copy everything into the Hash, then use the number of bytes written
-	// as the file size.
-	var readLen int64
-	readLen, err = io.Copy(hasher, multiReader)
-	if err != nil {
-		return
-	} else {
-		m.Size += readLen
+func NewMetadataHasher() *MetadataHasher {
+	return &MetadataHasher{
+		hasher: sha256.New(),
+		header: make([]byte, 0, sniffLen),
 	}
+}
+
+func (h *MetadataHasher) Write(p []byte) (int, error) {
+	// Keep the first bytes around for mimetype detection
+	if missing := sniffLen - len(h.header); missing > 0 {
+		if missing > len(p) {
+			missing = len(p)
+		}
+		h.header = append(h.header, p[:missing]...)
+	}
+
+	h.size += int64(len(p))
+	return h.hasher.Write(p)
+}
+
+// Metadata returns the size, sha256sum and mimetype of the data written so
+// far
+func (h *MetadataHasher) Metadata() (m backends.Metadata) {
+	m.Size = h.size
 
 	// Get the hex-encoded string version of the Hash checksum
-	m.Sha256sum = hex.EncodeToString(hasher.Sum(nil))
+	m.Sha256sum = hex.EncodeToString(h.hasher.Sum(nil))
 
-	// Use the bytes we extracted earlier and attempt to determine the file
-	// type
-	kind := mimetype.Detect(header[:headerlen])
+	// Use the bytes we kept earlier to attempt to determine the file type
+	kind := mimetype.Detect(h.header)
 	m.Mimetype = kind.String()
 
 	return
 }
 
+// Complete fills in the metadata given to Put with the size and sha256sum of
+// the data written so far, and its mimetype unless one was given
+func (h *MetadataHasher) Complete(m backends.Metadata) backends.Metadata {
+	computed := h.Metadata()
+	m.Size = computed.Size
+	m.Sha256sum = computed.Sha256sum
+	if m.Mimetype == "" {
+		m.Mimetype = computed.Mimetype
+	}
+	return m
+}
+
+func GenerateMetadata(r io.Reader) (m backends.Metadata, err error) {
+	hasher := NewMetadataHasher()
+
+	_, err = io.Copy(hasher, r)
+	if err != nil {
+		return
+	}
+
+	return hasher.Metadata(), nil
+}
+
 func printable(data []byte) bool {
 	for i, b := range data {
 		r := rune(b)
@@ -71,3 +71,33 @@ func TestTextCharsets(t *testing.T) {
 		}
 	}
 }
+
+func TestMetadataHasherChunks(t *testing.T) {
+	content := strings.Repeat("This is my test content\n", 100)
+
+	expected, err := GenerateMetadata(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Feed the data in pieces smaller than the sniffing window
+	hasher := NewMetadataHasher()
+	for i := 0; i < len(content); i += 7 {
+		end := i + 7
+		if end > len(content) {
+			end = len(content)
+		}
+		hasher.Write([]byte(content[i:end]))
+	}
+
+	m := hasher.Metadata()
+	if m.Sha256sum != expected.Sha256sum {
+		t.Fatalf("Sha256sum was %q instead of expected value of %q", m.Sha256sum, expected.Sha256sum)
+	}
+	if m.Mimetype != expected.Mimetype {
+		t.Fatalf("Mimetype was %q instead of expected value of %q", m.Mimetype, expected.Mimetype)
+	}
+	if m.Size != int64(len(content)) {
+		t.Fatalf("Size was %d instead of expected value of %d", m.Size, len(content))
+	}
+}
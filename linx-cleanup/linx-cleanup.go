@@ -2,22 +2,57 @@ package main
 
 import (
 	"flag"
+	"log"
 
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/s3"
 	"github.com/andreimarcu/linx-server/cleanup"
 )
 
 func main() {
 	var filesDir string
 	var metaDir string
+	var blobsDir string
+	var shardDepth int
+	var s3Endpoint string
+	var s3Region string
+	var s3Bucket string
+	var s3ForcePathStyle bool
 	var noLogs bool
 
 	flag.StringVar(&filesDir, "filespath", "files/",
 		"path to files directory")
 	flag.StringVar(&metaDir, "metapath", "meta/",
 		"path to metadata directory")
+	flag.StringVar(&blobsDir, "blobspath", "",
+		"path to deduplicated blobs directory (if enabled on the server)")
+	flag.IntVar(&shardDepth, "shard-depth", 0,
+		"number of subdirectory levels used by the server")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "",
+		"S3 endpoint")
+	flag.StringVar(&s3Region, "s3-region", "",
+		"S3 region")
+	flag.StringVar(&s3Bucket, "s3-bucket", "",
+		"S3 bucket to use for files and metadata")
+	flag.BoolVar(&s3ForcePathStyle, "s3-force-path-style", false,
+		"Force path-style addressing for S3 (e.g. https://s3.amazonaws.com/linx/example.txt)")
 	flag.BoolVar(&noLogs, "nologs", false,
 		"don't log deleted files")
 	flag.Parse()
 
-	cleanup.Cleanup(filesDir, metaDir, noLogs)
+	var fileBackend backends.MetaStorageBackend
+	if s3Bucket != "" {
+		fileBackend = s3.NewS3Backend(s3Bucket, s3Region, s3Endpoint, s3ForcePathStyle)
+	} else {
+		fileBackend = localfs.NewLocalfsBackendWithOptions(metaDir, filesDir, localfs.LocalfsOptions{
+			BlobsPath:  blobsDir,
+			ShardDepth: shardDepth,
+		})
+	}
+
+	err := cleanup.Cleanup(fileBackend, noLogs)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/andreimarcu/linx-server/backends/localfs"
+)
+
+func main() {
+	var filesDir string
+	var metaDir string
+	var blobsDir string
+	var shardDepth int
+	var noLogs bool
+
+	flag.StringVar(&filesDir, "filespath", "files/",
+		"path to files directory")
+	flag.StringVar(&metaDir, "metapath", "meta/",
+		"path to metadata directory")
+	flag.StringVar(&blobsDir, "blobspath", "blobs/",
+		"path to deduplicated blobs directory")
+	flag.IntVar(&shardDepth, "shard-depth", 0,
+		"number of subdirectory levels used by the server")
+	flag.BoolVar(&noLogs, "nologs", false,
+		"don't log converted files")
+	flag.Parse()
+
+	err := os.MkdirAll(blobsDir, 0755)
+	if err != nil {
+		log.Fatal("Could not create blobs directory:", err)
+	}
+
+	fileBackend := localfs.NewLocalfsBackendWithOptions(metaDir, filesDir, localfs.LocalfsOptions{
+		BlobsPath:  blobsDir,
+		ShardDepth: shardDepth,
+	})
+
+	err = fileBackend.List(func(filename string) error {
+		converted, err := fileBackend.Deduplicate(filename)
+		if err != nil {
+			log.Printf("Failed to deduplicate %s: %v", filename, err)
+		} else if converted && !noLogs {
+			log.Printf("Deduplicated %s", filename)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
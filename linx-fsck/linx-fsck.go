@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/andreimarcu/linx-server/backends/localfs"
+)
+
+func main() {
+	var filesDir string
+	var metaDir string
+	var blobsDir string
+	var shardDepth int
+	var noChecksums bool
+	var repair bool
+	var quarantineDir string
+
+	flag.StringVar(&filesDir, "filespath", "files/",
+		"path to files directory")
+	flag.StringVar(&metaDir, "metapath", "meta/",
+		"path to metadata directory")
+	flag.StringVar(&blobsDir, "blobspath", "",
+		"path to deduplicated blobs directory (if enabled on the server)")
+	flag.IntVar(&shardDepth, "shard-depth", 0,
+		"number of subdirectory levels used by the server")
+	flag.BoolVar(&noChecksums, "nochecksums", false,
+		"only compare sizes instead of reading every file to verify its sha256sum")
+	flag.BoolVar(&repair, "repair", false,
+		"repair the problems that are found")
+	flag.StringVar(&quarantineDir, "quarantine", "",
+		"move problematic files and metadata to this directory")
+	flag.Parse()
+
+	fileBackend := localfs.NewLocalfsBackendWithOptions(metaDir, filesDir, localfs.LocalfsOptions{
+		BlobsPath:  blobsDir,
+		ShardDepth: shardDepth,
+	})
+
+	var issues []localfs.Issue
+	err := fileBackend.Check(!noChecksums, func(issue localfs.Issue) {
+		issues = append(issues, issue)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	unresolved := 0
+	for _, issue := range issues {
+		name := issue.Key
+		if name == "" {
+			name = issue.Path
+		}
+
+		if quarantineDir != "" {
+			err = fileBackend.Quarantine(issue, quarantineDir)
+			if err == nil {
+				fmt.Printf("%s: %s (quarantined)\n", name, issue.Problem)
+				continue
+			}
+		} else if repair {
+			err = fileBackend.Repair(issue)
+			if err == nil {
+				fmt.Printf("%s: %s (repaired)\n", name, issue.Problem)
+				continue
+			}
+		}
+
+		if err != nil {
+			fmt.Printf("%s: %s (%v)\n", name, issue.Problem, err)
+		} else {
+			fmt.Printf("%s: %s\n", name, issue.Problem)
+		}
+		unresolved++
+	}
+
+	if unresolved > 0 {
+		os.Exit(1)
+	}
+}
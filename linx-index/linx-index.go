@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/andreimarcu/linx-server/backends/backendurl"
+	"github.com/andreimarcu/linx-server/backends/index"
+)
+
+func main() {
+	var backend string
+	var indexPath string
+	var noLogs bool
+
+	flag.StringVar(&backend, "backend", "localfs:files?meta=meta",
+		"backend to index, e.g. localfs:///srv/linx/files?meta=/srv/linx/meta or s3://bucket?region=us-east-1")
+	flag.StringVar(&indexPath, "indexpath", "",
+		"path to the index database to rebuild")
+	flag.BoolVar(&noLogs, "nologs", false,
+		"don't log the number of indexed files")
+	flag.Parse()
+
+	if indexPath == "" {
+		log.Fatal("-indexpath is required")
+	}
+
+	inner, err := backendurl.Open(backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := index.NewIndexedBackend(inner, indexPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer b.Close()
+
+	err = b.Rebuild(noLogs)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
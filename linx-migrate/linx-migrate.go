@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/andreimarcu/linx-server/backends/backendurl"
+	"github.com/andreimarcu/linx-server/backends/migrate"
+)
+
+func main() {
+	var from string
+	var to string
+	var o migrate.Options
+
+	flag.StringVar(&from, "from", "",
+		"backend to copy from, e.g. localfs:///srv/linx/files?meta=/srv/linx/meta")
+	flag.StringVar(&to, "to", "",
+		"backend to copy to, e.g. s3://bucket?region=us-east-1")
+	flag.IntVar(&o.Workers, "workers", 4,
+		"number of files to copy at the same time")
+	flag.BoolVar(&o.Verify, "verify", false,
+		"read every file back and compare its sha256 with the source")
+	flag.BoolVar(&o.DryRun, "dry-run", false,
+		"only log what would be copied")
+	flag.BoolVar(&o.NoLogs, "nologs", false,
+		"don't log copied files")
+	flag.Parse()
+
+	if from == "" || to == "" {
+		log.Fatal("Both -from and -to are required")
+	}
+
+	src, err := backendurl.Open(from)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dst, err := backendurl.Open(to)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed, err := migrate.Migrate(src, dst, o)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if failed > 0 {
+		log.Printf("%d files could not be copied", failed)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/andreimarcu/linx-server/backends/backendurl"
+	"github.com/andreimarcu/linx-server/backends/encrypted"
+)
+
+func main() {
+	var backend string
+	var keyFile string
+	var noLogs bool
+
+	flag.StringVar(&backend, "backend", "localfs:files?meta=meta",
+		"backend to re-encrypt, e.g. localfs:///srv/linx/files?meta=/srv/linx/meta or s3://bucket?region=us-east-1")
+	flag.StringVar(&keyFile, "encryption-keyfile", "",
+		"path to the file of master keys, with the new key first")
+	flag.BoolVar(&noLogs, "nologs", false,
+		"don't log re-encrypted files")
+	flag.Parse()
+
+	if keyFile == "" {
+		log.Fatal("-encryption-keyfile is required")
+	}
+
+	keys, err := encrypted.LoadKeyring(keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	inner, err := backendurl.Open(backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := encrypted.NewEncryptedBackend(inner, keys)
+
+	failed := 0
+	err = b.List(func(filename string) error {
+		changed, err := b.Reencrypt(filename)
+		if err != nil {
+			log.Printf("Failed to re-encrypt %s: %v", filename, err)
+			failed++
+		} else if changed && !noLogs {
+			log.Printf("Re-encrypted %s", filename)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if failed > 0 {
+		log.Printf("%d files could not be re-encrypted", failed)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/andreimarcu/linx-server/backends/localfs"
+)
+
+func main() {
+	var filesDir string
+	var metaDir string
+	var fromDepth int
+	var toDepth int
+	var noLogs bool
+
+	flag.StringVar(&filesDir, "filespath", "files/",
+		"path to files directory")
+	flag.StringVar(&metaDir, "metapath", "meta/",
+		"path to metadata directory")
+	flag.IntVar(&fromDepth, "from", 0,
+		"shard depth the directories currently use")
+	flag.IntVar(&toDepth, "to", 2,
+		"shard depth to convert the directories to")
+	flag.BoolVar(&noLogs, "nologs", false,
+		"don't log moved files")
+	flag.Parse()
+
+	for _, depth := range []int{fromDepth, toDepth} {
+		if depth < 0 || depth > localfs.MaxShardDepth {
+			log.Fatalf("Shard depth must be between 0 and %d", localfs.MaxShardDepth)
+		}
+	}
+
+	src := localfs.NewLocalfsBackendWithOptions(metaDir, filesDir, localfs.LocalfsOptions{
+		ShardDepth: fromDepth,
+	})
+	dst := localfs.NewLocalfsBackendWithOptions(metaDir, filesDir, localfs.LocalfsOptions{
+		ShardDepth: toDepth,
+	})
+
+	err := src.List(func(filename string) error {
+		err := dst.Relocate(filename, src)
+		if err != nil {
+			log.Printf("Failed to move %s: %v", filename, err)
+		} else if !noLogs {
+			log.Printf("Moved %s", filename)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
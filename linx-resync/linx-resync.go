@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/andreimarcu/linx-server/backends/backendurl"
+	"github.com/andreimarcu/linx-server/backends/mirror"
+)
+
+func main() {
+	var from string
+	var to string
+	var o mirror.ResyncOptions
+
+	flag.StringVar(&from, "from", "",
+		"backend holding the up to date copy, e.g. localfs:///mnt/a/files?meta=/mnt/a/meta")
+	flag.StringVar(&to, "to", "",
+		"lagging backend to bring in line, e.g. s3://bucket?region=us-east-1")
+	flag.BoolVar(&o.DeleteExtra, "delete", false,
+		"delete files that only exist on the lagging backend")
+	flag.BoolVar(&o.DryRun, "dry-run", false,
+		"only log what would be changed")
+	flag.BoolVar(&o.NoLogs, "nologs", false,
+		"don't log copied files")
+	flag.Parse()
+
+	if from == "" || to == "" {
+		log.Fatal("Both -from and -to are required")
+	}
+
+	src, err := backendurl.Open(from)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dst, err := backendurl.Open(to)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = mirror.Resync(src, dst, o)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -44,6 +44,7 @@ func apiDocHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	err := renderTemplate(Templates["API.html"], pongo2.Context{
 		"siteurl":     getSiteURL(r),
 		"forcerandom": Config.forceRandomFilename,
+		"tus":         Config.tusDir != "",
 	}, r, w)
 	if err != nil {
 		oopsHandler(c, w, r, RespHTML, "")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"compress/gzip"
 	"flag"
 	"log"
 	"net"
@@ -18,8 +19,16 @@ import (
 	rice "github.com/GeertJohan/go.rice"
 	"github.com/andreimarcu/linx-server/auth/apikeys"
 	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/backendurl"
+	"github.com/andreimarcu/linx-server/backends/cache"
+	"github.com/andreimarcu/linx-server/backends/compressed"
+	"github.com/andreimarcu/linx-server/backends/encrypted"
+	"github.com/andreimarcu/linx-server/backends/index"
 	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/memory"
+	"github.com/andreimarcu/linx-server/backends/mirror"
 	"github.com/andreimarcu/linx-server/backends/s3"
+	"github.com/andreimarcu/linx-server/backends/tiered"
 	"github.com/andreimarcu/linx-server/cleanup"
 	"github.com/flosch/pongo2"
 	"github.com/vharitonsky/iniflags"
@@ -43,6 +52,11 @@ var Config struct {
 	bind                      string
 	filesDir                  string
 	metaDir                   string
+	blobsDir                  string
+	indexPath                 string
+	tusDir                    string
+	tusExpiryMinutes          uint64
+	shardDepth                int
 	siteName                  string
 	siteURL                   string
 	sitePath                  string
@@ -56,6 +70,7 @@ var Config struct {
 	xFrameOptions             string
 	maxSize                   int64
 	maxExpiry                 uint64
+	slidingExpiry             uint64
 	realIp                    bool
 	noLogs                    bool
 	allowHotlink              bool
@@ -70,6 +85,20 @@ var Config struct {
 	s3Region                  string
 	s3Bucket                  string
 	s3ForcePathStyle          bool
+	s3Presign                 bool
+	s3PresignExpiry           uint64
+	s3CacheDir                string
+	s3CacheMaxSize            int64
+	tiered                    bool
+	tieredMaxHotSize          int64
+	tieredMaxAgeMinutes       uint64
+	tieredMaxIdleMinutes      uint64
+	tieredMigrateEveryMinutes uint64
+	mirrors                   headerList
+	encryptionKeyFile         string
+	compression               bool
+	memoryStorage             bool
+	memoryStorageMaxSize      int64
 	forceRandomFilename       bool
 	accessKeyCookieExpiry     uint64
 	customPagesDir            string
@@ -121,14 +150,34 @@ func setup() *web.Mux {
 	}
 
 	// make directories if needed
-	err := os.MkdirAll(Config.filesDir, 0755)
-	if err != nil {
-		log.Fatal("Could not create files directory:", err)
+	if !Config.memoryStorage {
+		err := os.MkdirAll(Config.filesDir, 0755)
+		if err != nil {
+			log.Fatal("Could not create files directory:", err)
+		}
+
+		err = os.MkdirAll(Config.metaDir, 0700)
+		if err != nil {
+			log.Fatal("Could not create metadata directory:", err)
+		}
 	}
 
-	err = os.MkdirAll(Config.metaDir, 0700)
-	if err != nil {
-		log.Fatal("Could not create metadata directory:", err)
+	if Config.tusDir != "" {
+		err := os.MkdirAll(Config.tusDir, 0700)
+		if err != nil {
+			log.Fatal("Could not create resumable uploads directory:", err)
+		}
+	}
+
+	if Config.shardDepth < 0 || Config.shardDepth > localfs.MaxShardDepth {
+		log.Fatalf("Shard depth must be between 0 and %d", localfs.MaxShardDepth)
+	}
+
+	if Config.blobsDir != "" {
+		err := os.MkdirAll(Config.blobsDir, 0755)
+		if err != nil {
+			log.Fatal("Could not create blobs directory:", err)
+		}
 	}
 
 	if Config.siteURL != "" {
@@ -152,14 +201,115 @@ func setup() *web.Mux {
 		Config.selifPath = Config.selifPath + "/"
 	}
 
+	localBackend := localfs.NewLocalfsBackendWithOptions(Config.metaDir, Config.filesDir, localfs.LocalfsOptions{
+		BlobsPath:  Config.blobsDir,
+		ShardDepth: Config.shardDepth,
+	})
+
+	if Config.tiered && Config.s3Bucket == "" {
+		log.Fatal("Tiered storage requires an S3 bucket")
+	}
+
+	var s3Backend backends.MetaStorageBackend
 	if Config.s3Bucket != "" {
-		storageBackend = s3.NewS3Backend(Config.s3Bucket, Config.s3Region, Config.s3Endpoint, Config.s3ForcePathStyle)
+		s3Backend = s3.NewS3Backend(Config.s3Bucket, Config.s3Region, Config.s3Endpoint, Config.s3ForcePathStyle)
+	}
+	if s3Backend != nil && Config.s3CacheDir != "" {
+		cachedBackend, err := cache.NewCachedBackend(s3Backend, Config.s3CacheDir, Config.s3CacheMaxSize)
+		if err != nil {
+			log.Fatal("Could not set up S3 cache:", err)
+		}
+		if !Config.noLogs {
+			go cachedBackend.PeriodicLogStats(time.Hour)
+		}
+		s3Backend = cachedBackend
+	}
+
+	if Config.memoryStorage {
+		metaStorageBackend = memory.NewMemoryBackend(Config.memoryStorageMaxSize)
+	} else if Config.tiered {
+		tieredBackend := tiered.NewTieredBackend(localBackend, s3Backend,
+			tiered.TieredOptions{
+				MaxHotSize: Config.tieredMaxHotSize,
+				MaxAge:     time.Duration(Config.tieredMaxAgeMinutes) * time.Minute,
+				MaxIdle:    time.Duration(Config.tieredMaxIdleMinutes) * time.Minute,
+			})
+		if Config.tieredMigrateEveryMinutes > 0 {
+			go tieredBackend.PeriodicMigrate(time.Duration(Config.tieredMigrateEveryMinutes)*time.Minute, Config.noLogs)
+		}
+		metaStorageBackend = tieredBackend
+	} else if s3Backend != nil {
+		metaStorageBackend = s3Backend
 	} else {
-		storageBackend = localfs.NewLocalfsBackend(Config.metaDir, Config.filesDir)
-		if Config.cleanupEveryMinutes > 0 {
-			go cleanup.PeriodicCleanup(time.Duration(Config.cleanupEveryMinutes)*time.Minute, Config.filesDir, Config.metaDir, Config.noLogs)
+		metaStorageBackend = localBackend
+	}
+
+	if len(Config.mirrors) > 0 {
+		replicas := []backends.MetaStorageBackend{metaStorageBackend}
+		for _, spec := range Config.mirrors {
+			replica, err := backendurl.Open(spec)
+			if err != nil {
+				log.Fatal("Could not set up mirror:", err)
+			}
+			replicas = append(replicas, replica)
+		}
+		metaStorageBackend = mirror.NewMirrorBackend(replicas...)
+	}
+
+	if Config.indexPath != "" {
+		_, err := os.Stat(Config.indexPath)
+		build := os.IsNotExist(err)
+
+		indexedBackend, err := index.NewIndexedBackend(metaStorageBackend, Config.indexPath)
+		if err != nil {
+			log.Fatal("Could not open metadata index:", err)
+		}
+		if build {
+			err = indexedBackend.Rebuild(Config.noLogs)
+			if err != nil {
+				os.Remove(Config.indexPath)
+				log.Fatal("Could not build metadata index:", err)
+			}
+		}
+		metaStorageBackend = indexedBackend
+	}
+
+	// Cleanup only needs the expiry of files, which is never encrypted,
+	// and can use the index directly
+	cleanupBackend := metaStorageBackend
+
+	if Config.encryptionKeyFile != "" {
+		if Config.blobsDir != "" {
+			log.Fatal("Encryption can't be combined with deduplicated blobs")
+		}
+
+		keys, err := encrypted.LoadKeyring(Config.encryptionKeyFile)
+		if err != nil {
+			log.Fatal("Could not load encryption keys:", err)
 		}
+		metaStorageBackend = encrypted.NewEncryptedBackend(metaStorageBackend, keys)
+	}
 
+	// compress before encrypting, encrypted data doesn't compress
+	if Config.compression {
+		// blobs are found by the checksum in the metadata, which describes
+		// the uncompressed file
+		if Config.blobsDir != "" {
+			log.Fatal("Compression can't be combined with deduplicated blobs")
+		}
+
+		metaStorageBackend = compressed.NewCompressedBackend(metaStorageBackend, gzip.DefaultCompression)
+	}
+	storageBackend = metaStorageBackend
+
+	if Config.s3Presign {
+		if _, ok := storageBackend.(backends.PresignedStorageBackend); !ok {
+			log.Print("Warning: S3 presigning is not supported with this storage setup, files will be proxied")
+		}
+	}
+
+	if Config.cleanupEveryMinutes > 0 {
+		go cleanup.PeriodicCleanup(time.Duration(Config.cleanupEveryMinutes)*time.Minute, cleanupBackend, Config.noLogs)
 	}
 
 	// Template setup
@@ -182,6 +332,7 @@ func setup() *web.Mux {
 	selifRe := regexp.MustCompile("^" + Config.sitePath + Config.selifPath + `(?P<name>[a-z0-9-\.]+)$`)
 	selifIndexRe := regexp.MustCompile("^" + Config.sitePath + Config.selifPath + `$`)
 	torrentRe := regexp.MustCompile("^" + Config.sitePath + `(?P<name>[a-z0-9-\.]+)/torrent$`)
+	tarballRe := regexp.MustCompile("^" + Config.sitePath + `(?P<name>[a-z0-9-\.]+)/tarball$`)
 
 	if Config.authFile == "" || Config.basicAuth {
 		mux.Get(Config.sitePath, indexHandler)
@@ -210,6 +361,20 @@ func setup() *web.Mux {
 	mux.Put(Config.sitePath+"upload/", uploadPutHandler)
 	mux.Put(Config.sitePath+"upload/:name", uploadPutHandler)
 
+	if Config.tusDir != "" {
+		mux.Options(Config.sitePath+"tus/", tusOptionsHandler)
+		mux.Options(Config.sitePath+"tus/:id", tusOptionsHandler)
+		mux.Post(Config.sitePath+"tus", tusCreateHandler)
+		mux.Post(Config.sitePath+"tus/", tusCreateHandler)
+		mux.Head(Config.sitePath+"tus/:id", tusHeadHandler)
+		mux.Patch(Config.sitePath+"tus/:id", tusPatchHandler)
+		mux.Delete(Config.sitePath+"tus/:id", tusDeleteHandler)
+
+		if Config.tusExpiryMinutes > 0 {
+			go tusPeriodicCleanup(time.Hour)
+		}
+	}
+
 	mux.Delete(Config.sitePath+":name", deleteHandler)
 
 	mux.Get(Config.sitePath+"static/*", staticHandler)
@@ -220,6 +385,7 @@ func setup() *web.Mux {
 	mux.Get(selifRe, fileServeHandler)
 	mux.Get(selifIndexRe, unauthorizedHandler)
 	mux.Get(torrentRe, fileTorrentHandler)
+	mux.Get(tarballRe, collectionTarballHandler)
 
 	if Config.customPagesDir != "" {
 		initializeCustomPages(Config.customPagesDir)
@@ -241,6 +407,16 @@ func main() {
 		"path to files directory")
 	flag.StringVar(&Config.metaDir, "metapath", "meta/",
 		"path to metadata directory")
+	flag.StringVar(&Config.blobsDir, "blobspath", "",
+		"path to content-addressed blobs directory, enables deduplication of identical uploads (must be on the same filesystem as filespath)")
+	flag.StringVar(&Config.indexPath, "indexpath", "",
+		"path to a database indexing the metadata of all files, to avoid reading it from storage (built on first use)")
+	flag.StringVar(&Config.tusDir, "tuspath", "",
+		"path to keep partial resumable (tus) uploads in, enables resumable uploads")
+	flag.Uint64Var(&Config.tusExpiryMinutes, "tus-expiry-minutes", 1440,
+		"how long partial resumable uploads are kept after they were last written to (0 to keep them forever)")
+	flag.IntVar(&Config.shardDepth, "shard-depth", 0,
+		"number of subdirectory levels to spread files and metadata over (default is 0, which stores everything in one directory)")
 	flag.BoolVar(&Config.basicAuth, "basicauth", false,
 		"allow logging by basic auth password")
 	flag.BoolVar(&Config.noLogs, "nologs", false,
@@ -257,6 +433,8 @@ func main() {
 		"maximum upload file size in bytes (default 4GB)")
 	flag.Uint64Var(&Config.maxExpiry, "maxexpiry", 0,
 		"maximum expiration time in seconds (default is 0, which is no expiry)")
+	flag.Uint64Var(&Config.slidingExpiry, "sliding-expiry", 0,
+		"expire files once they haven't been downloaded or displayed for this many seconds, and at the latest at the expiry they were uploaded with (default is 0, which is fixed expiry)")
 	flag.StringVar(&Config.certFile, "certfile", "",
 		"path to ssl certificate (for https)")
 	flag.StringVar(&Config.keyFile, "keyfile", "",
@@ -297,6 +475,34 @@ func main() {
 		"S3 bucket to use for files and metadata")
 	flag.BoolVar(&Config.s3ForcePathStyle, "s3-force-path-style", false,
 		"Force path-style addressing for S3 (e.g. https://s3.amazonaws.com/linx/example.txt)")
+	flag.BoolVar(&Config.s3Presign, "s3-presign", false,
+		"redirect file downloads to presigned S3 URLs instead of proxying them")
+	flag.Uint64Var(&Config.s3PresignExpiry, "s3-presign-expiry", 60,
+		"how long presigned S3 URLs are valid for in seconds")
+	flag.StringVar(&Config.s3CacheDir, "s3-cache-dir", "",
+		"cache recently downloaded files from the S3 bucket in this directory")
+	flag.Int64Var(&Config.s3CacheMaxSize, "s3-cache-max-size", 1024*1024*1024,
+		"maximum size of files cached in s3-cache-dir in bytes")
+	flag.BoolVar(&Config.tiered, "tiered", false,
+		"keep small and recent files in filespath and move the rest to the S3 bucket")
+	flag.Int64Var(&Config.tieredMaxHotSize, "tiered-max-local-size", 10*1024*1024,
+		"uploads larger than this many bytes are stored in the S3 bucket straight away")
+	flag.Uint64Var(&Config.tieredMaxAgeMinutes, "tiered-max-age-minutes", 1440,
+		"move files to the S3 bucket once they are this old in minutes (0 to disable)")
+	flag.Uint64Var(&Config.tieredMaxIdleMinutes, "tiered-max-idle-minutes", 0,
+		"move files to the S3 bucket once they haven't been downloaded for this long in minutes (0 to disable)")
+	flag.Uint64Var(&Config.tieredMigrateEveryMinutes, "tiered-migrate-every-minutes", 10,
+		"how often to move files to the S3 bucket in minutes")
+	flag.Var(&Config.mirrors, "mirror",
+		"also store every file on this backend, e.g. localfs:///mnt/b/files?meta=/mnt/b/meta or s3://bucket?region=us-east-1. This option can be used multiple times.")
+	flag.StringVar(&Config.encryptionKeyFile, "encryption-keyfile", "",
+		"path to a file of master keys to encrypt stored files and metadata with")
+	flag.BoolVar(&Config.compression, "compression", false,
+		"store text files gzipped and send them as they are to clients that accept gzip")
+	flag.BoolVar(&Config.memoryStorage, "memory-storage", false,
+		"keep files and metadata in memory only (they are lost when the server exits)")
+	flag.Int64Var(&Config.memoryStorageMaxSize, "memory-storage-max-size", 0,
+		"maximum size of files kept in memory in bytes (default is 0, which means no limit)")
 	flag.BoolVar(&Config.forceRandomFilename, "force-random-filename", false,
 		"Force all uploads to use a random filename")
 	flag.Uint64Var(&Config.accessKeyCookieExpiry, "access-cookie-expiry", 0, "Expiration time for access key cookies in seconds (set 0 to use session cookies)")
@@ -1,20 +1,26 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
-	"path"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/zenazn/goji/web"
 )
 
 type RespOkJSON struct {
@@ -31,8 +37,7 @@ type RespErrJSON struct {
 
 func TestSetup(t *testing.T) {
 	Config.siteURL = "http://linx.example.org/"
-	Config.filesDir = path.Join(os.TempDir(), generateBarename())
-	Config.metaDir = Config.filesDir + "_meta"
+	Config.memoryStorage = true
 	Config.maxSize = 1024 * 1024 * 1024
 	Config.noLogs = true
 	Config.siteName = "linx"
@@ -478,6 +483,14 @@ func TestPostJSONUploadMaxExpiry(t *testing.T) {
 
 		mux.ServeHTTP(w, req)
 
+		// negative expiries are rejected rather than capped
+		if expiry == "-150" {
+			if w.Code != 400 {
+				t.Fatalf("Status code is not 400, but %d", w.Code)
+			}
+			continue
+		}
+
 		if w.Code != 200 {
 			t.Log(w.Body.String())
 			t.Fatalf("Status code is not 200, but %d", w.Code)
@@ -617,86 +630,141 @@ func TestPostRandomizeJSONUpload(t *testing.T) {
 	}
 }
 
-func TestPostEmptyUpload(t *testing.T) {
-	mux := setup()
-	w := httptest.NewRecorder()
+func TestPostMultipartFieldOrder(t *testing.T) {
+	for _, fieldsFirst := range []bool{true, false} {
+		mux := setup()
+		w := httptest.NewRecorder()
 
-	filename := generateBarename() + ".txt"
+		filename := generateBarename() + ".txt"
 
-	var b bytes.Buffer
-	mw := multipart.NewWriter(&b)
-	fw, err := mw.CreateFormFile("file", filename)
-	if err != nil {
-		t.Fatal(err)
-	}
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		writeFile := func() {
+			fw, err := mw.CreateFormFile("file", filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte("File content"))
+		}
 
-	fw.Write([]byte(""))
-	mw.Close()
+		if !fieldsFirst {
+			writeFile()
+		}
+		for name, value := range map[string]string{"expires": "60", "randomize": "true", "access_key": "secret"} {
+			if err := mw.WriteField(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if fieldsFirst {
+			writeFile()
+		}
+		mw.Close()
 
-	req, err := http.NewRequest("POST", "/upload/", &b)
-	req.Header.Set("Content-Type", mw.FormDataContentType())
-	req.Header.Set("Referer", Config.siteURL)
-	if err != nil {
-		t.Fatal(err)
-	}
+		req, err := http.NewRequest("POST", "/upload/", &b)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Referer", Config.siteURL)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	mux.ServeHTTP(w, req)
+		mux.ServeHTTP(w, req)
 
-	if w.Code != 400 {
-		t.Log(w.Body.String())
-		t.Fatalf("Status code is not 400, but %d", w.Code)
+		if w.Code != 200 {
+			t.Log(w.Body.String())
+			t.Fatalf("Status code is not 200, but %d", w.Code)
+		}
+
+		var myjson RespOkJSON
+		err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if myjson.Filename == filename {
+			t.Fatalf("Filename (%s) is not random (%s)", filename, myjson.Filename)
+		}
+		if _, err := storageBackend.Head(filename); err != backends.NotFoundErr {
+			t.Fatalf("File was also stored under its original name: %v", err)
+		}
+
+		metadata, err := storageBackend.Head(myjson.Filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.AccessKey != "secret" {
+			t.Fatalf("Access key was not set, got %q", metadata.AccessKey)
+		}
+		if metadata.Expiry.Before(time.Now()) || metadata.Expiry.After(time.Now().Add(time.Minute)) {
+			t.Fatalf("Expiry was not set to 60 seconds, got %v", metadata.Expiry)
+		}
 	}
 }
 
-func TestPostTooLargeUpload(t *testing.T) {
+func TestPostMultipartHeaderDefaults(t *testing.T) {
 	mux := setup()
-	oldMaxSize := Config.maxSize
-	Config.maxSize = 2
 	w := httptest.NewRecorder()
 
-	filename := generateBarename() + ".txt"
-
 	var b bytes.Buffer
 	mw := multipart.NewWriter(&b)
-	fw, err := mw.CreateFormFile("file", filename)
+	if err := mw.WriteField("expires", "60"); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := mw.CreateFormFile("file", generateBarename()+".txt")
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	fw.Write([]byte("test content"))
+	fw.Write([]byte("File content"))
 	mw.Close()
 
 	req, err := http.NewRequest("POST", "/upload/", &b)
-	req.Header.Set("Content-Type", mw.FormDataContentType())
-	req.Header.Set("Referer", Config.siteURL)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Linx-Max-Downloads", "2")
+	req.Header.Set("Linx-Expiry", "3600")
 
 	mux.ServeHTTP(w, req)
 
-	if w.Code != 400 {
+	if w.Code != 200 {
 		t.Log(w.Body.String())
-		t.Fatalf("Status code is not 400, but %d", w.Code)
+		t.Fatalf("Status code is not 200, but %d", w.Code)
 	}
 
-	Config.maxSize = oldMaxSize
+	var myjson RespOkJSON
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// headers apply unless the form sets the same thing
+	metadata, err := storageBackend.Head(myjson.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.MaxDownloads != 2 {
+		t.Fatalf("Download limit of the header was not set, got %d", metadata.MaxDownloads)
+	}
+	if metadata.Expiry.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("Expiry of the form was not set, got %v", metadata.Expiry)
+	}
 }
 
-func TestPostEmptyJSONUpload(t *testing.T) {
+func TestPostCollectionUpload(t *testing.T) {
 	mux := setup()
 	w := httptest.NewRecorder()
 
-	filename := generateBarename() + ".txt"
-
 	var b bytes.Buffer
 	mw := multipart.NewWriter(&b)
-	fw, err := mw.CreateFormFile("file", filename)
-	if err != nil {
-		t.Fatal(err)
+	for _, name := range []string{"one.txt", "two.txt"} {
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("Content of " + name))
 	}
-
-	fw.Write([]byte(""))
 	mw.Close()
 
 	req, err := http.NewRequest("POST", "/upload/", &b)
@@ -709,289 +777,1171 @@ func TestPostEmptyJSONUpload(t *testing.T) {
 
 	mux.ServeHTTP(w, req)
 
-	if w.Code != 400 {
+	if w.Code != 200 {
 		t.Log(w.Body.String())
-		t.Fatalf("Status code is not 400, but %d", w.Code)
+		t.Fatalf("Status code is not 200, but %d", w.Code)
 	}
 
-	var myjson RespErrJSON
+	var myjson struct {
+		RespOkJSON
+		Files []RespOkJSON
+	}
 	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if myjson.Error != "Empty file" {
-		t.Fatal("Json 'error' was not 'Empty file' but " + myjson.Error)
+	if len(myjson.Files) != 2 || myjson.Files[0].Filename != "one.txt" || myjson.Files[1].Filename != "two.txt" {
+		t.Fatalf("Unexpected files %+v", myjson.Files)
+	}
+	if myjson.Files[0].Delete_Key != myjson.Delete_Key || myjson.Files[1].Delete_Key != myjson.Delete_Key {
+		t.Fatal("Files don't share the delete key of the collection")
 	}
-}
-
-func TestPutUpload(t *testing.T) {
-	mux := setup()
-	w := httptest.NewRecorder()
-
-	filename := generateBarename() + ".file"
 
-	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+myjson.Filename, nil)
+	req.Header.Set("Accept", "application/json")
 	if err != nil {
 		t.Fatal(err)
 	}
-
 	mux.ServeHTTP(w, req)
 
-	if w.Body.String() != fmt.Sprintf("%s\n", Config.siteURL+filename) {
-		t.Fatal("Response was not expected URL")
+	var listing struct {
+		Files []struct {
+			Filename string
+			Name     string
+		}
 	}
-}
-
-func TestPutRandomizedUpload(t *testing.T) {
-	mux := setup()
-	w := httptest.NewRecorder()
-
-	filename := generateBarename() + ".file"
-
-	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	err = json.Unmarshal([]byte(w.Body.String()), &listing)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(listing.Files) != 2 || listing.Files[1].Filename != "two.txt" || listing.Files[1].Name != "two.txt" {
+		t.Fatalf("Unexpected listing %s", w.Body.String())
+	}
 
-	req.Header.Set("Linx-Randomize", "yes")
-
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+myjson.Filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 	mux.ServeHTTP(w, req)
 
-	if w.Body.String() == Config.siteURL+filename {
-		t.Fatal("Filename was not random")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), Config.selifPath+"two.txt") {
+		t.Fatalf("Collection page doesn't list its files: %d %s", w.Code, w.Body.String())
 	}
-}
-
-func TestPutForceRandomUpload(t *testing.T) {
-	mux := setup()
-	w := httptest.NewRecorder()
-
-	oldFRF := Config.forceRandomFilename
-	Config.forceRandomFilename = true
-	filename := "randomizeme.file"
 
-	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("DELETE", "/"+myjson.Filename, nil)
+	req.Header.Set("Linx-Delete-Key", myjson.Delete_Key)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// while this should also work without this header, let's try to force
-	// the randomized filename off to be sure
-	req.Header.Set("Linx-Randomize", "no")
-
 	mux.ServeHTTP(w, req)
 
-	if w.Body.String() == Config.siteURL+filename {
-		t.Fatal("Filename was not random")
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	for _, name := range []string{myjson.Filename, "one.txt", "two.txt"} {
+		if _, err := storageBackend.Head(name); err != backends.NotFoundErr {
+			t.Fatalf("%s was not deleted: %v", name, err)
+		}
 	}
-
-	Config.forceRandomFilename = oldFRF
 }
 
-func TestPutNoExtensionUpload(t *testing.T) {
+func TestCollectionReplacedMember(t *testing.T) {
 	mux := setup()
 	w := httptest.NewRecorder()
 
-	filename := generateBarename()
+	names := []string{generateBarename() + ".txt", generateBarename() + ".txt"}
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for _, name := range names {
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("Content of " + name))
+	}
+	mw.Close()
 
-	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
 	if err != nil {
 		t.Fatal(err)
 	}
+	mux.ServeHTTP(w, req)
 
-	req.Header.Set("Linx-Randomize", "yes")
+	var myjson RespOkJSON
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
 
+	// delete a file of the collection, and have someone else upload
+	// another one under its name
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("DELETE", "/"+names[1], nil)
+	req.Header.Set("Linx-Delete-Key", myjson.Delete_Key)
+	if err != nil {
+		t.Fatal(err)
+	}
 	mux.ServeHTTP(w, req)
 
-	if w.Body.String() == Config.siteURL+filename {
-		t.Fatal("Filename was not random")
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("PUT", "/upload/"+names[1], strings.NewReader("Someone else's content"))
+	req.Header.Set("Linx-Access-Key", "secret")
+	req.Header.Set("Accept", "application/json")
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestPutEmptyUpload(t *testing.T) {
-	mux := setup()
-	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
 
-	filename := generateBarename() + ".file"
+	var other RespOkJSON
+	err = json.Unmarshal([]byte(w.Body.String()), &other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Filename != names[1] {
+		t.Fatalf("File was stored as %s instead of %s", other.Filename, names[1])
+	}
 
-	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader(""))
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+myjson.Filename, nil)
+	req.Header.Set("Accept", "application/json")
 	if err != nil {
 		t.Fatal(err)
 	}
+	mux.ServeHTTP(w, req)
 
-	req.Header.Set("Linx-Randomize", "yes")
+	if strings.Contains(w.Body.String(), names[1]) {
+		t.Fatalf("Collection lists a file it doesn't hold: %s", w.Body.String())
+	}
 
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+myjson.Filename+"/tarball", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 	mux.ServeHTTP(w, req)
 
-	if w.Code != 400 {
-		t.Fatalf("Status code is not 400, but %d", w.Code)
+	tr := tar.NewReader(w.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != names[0] {
+			t.Fatalf("Tarball holds %s, which isn't part of the collection", hdr.Name)
+		}
 	}
 }
 
-func TestPutTooLargeUpload(t *testing.T) {
+func TestPostCollectionDuplicateNames(t *testing.T) {
 	mux := setup()
-	oldMaxSize := Config.maxSize
-	Config.maxSize = 2
-
 	w := httptest.NewRecorder()
 
-	filename := generateBarename() + ".file"
+	filename := generateBarename() + ".txt"
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for _, content := range []string{"First content", "Second content"} {
+		fw, err := mw.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	mw.Close()
 
-	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File too big"))
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	req.Header.Set("Linx-Randomize", "yes")
-
 	mux.ServeHTTP(w, req)
 
-	if w.Code != 500 {
+	if w.Code != 200 {
 		t.Log(w.Body.String())
-		t.Fatalf("Status code is not 500, but %d", w.Code)
+		t.Fatalf("Status code is not 200, but %d", w.Code)
 	}
 
-	if !strings.Contains(w.Body.String(), "request body too large") {
+	var myjson struct {
+		RespOkJSON
+		Files []RespOkJSON
+	}
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(myjson.Files) != 2 || myjson.Files[0].Filename == myjson.Files[1].Filename {
+		t.Fatalf("Files with the same name were not stored apart: %+v", myjson.Files)
+	}
+
+	for i, content := range []string{"First content", "Second content"} {
+		w = httptest.NewRecorder()
+		req, err = http.NewRequest("GET", "/"+Config.selifPath+myjson.Files[i].Filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(w, req)
+
+		if w.Body.String() != content {
+			t.Fatalf("%s holds %q instead of %q", myjson.Files[i].Filename, w.Body.String(), content)
+		}
+	}
+}
+
+func TestPostMultiFilePaste(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	form := url.Values{
+		"content":   {"listen = 80", "", "started on port 80"},
+		"filename":  {"server", "", "server"},
+		"extension": {"conf", "", "log"},
+	}
+	req, err := http.NewRequest("POST", "/upload", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", Config.siteURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 303 {
+		t.Fatalf("Status code is not 303, but %d", w.Code)
+	}
+	name := strings.TrimPrefix(w.Header().Get("Location"), Config.sitePath)
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	for _, s := range []string{"listen = 80", "started on port 80", Config.selifPath + "server.conf", Config.selifPath + "server.log"} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Fatalf("Paste page doesn't contain %q", s)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+name+"/tarball", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	contents := make(map[string]string)
+	tr := tar.NewReader(w.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[hdr.Name] = string(b)
+	}
+	if len(contents) != 2 || contents["server.conf"] != "listen = 80" || contents["server.log"] != "started on port 80" {
+		t.Fatalf("Unexpected tarball contents %v", contents)
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/server.conf/tarball", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Fatalf("Tarball of a file that isn't a collection: status code is not 404, but %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+name+"/tarball", nil)
+	req.Header.Set("Referer", "https://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 303 || w.Header().Get("Location") != Config.sitePath+name {
+		t.Fatalf("Hotlinked tarball was not redirected to the collection: %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestPostMultiFilePasteDuplicateNames(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename()
+	form := url.Values{
+		"content":   {"First paste", "Second paste"},
+		"filename":  {filename, filename},
+		"extension": {"txt", "txt"},
+	}
+	req, err := http.NewRequest("POST", "/upload", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson struct {
+		RespOkJSON
+		Files []RespOkJSON
+	}
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(myjson.Files) != 2 || myjson.Files[0].Filename == myjson.Files[1].Filename {
+		t.Fatalf("Pastes with the same name were not stored apart: %+v", myjson.Files)
+	}
+
+	for i, content := range form["content"] {
+		w = httptest.NewRecorder()
+		req, err = http.NewRequest("GET", "/"+Config.selifPath+myjson.Files[i].Filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(w, req)
+
+		if w.Body.String() != content {
+			t.Fatalf("%s holds %q instead of %q", myjson.Files[i].Filename, w.Body.String(), content)
+		}
+	}
+}
+
+func TestPostEmptyUpload(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".txt"
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fw.Write([]byte(""))
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Referer", Config.siteURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 400 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+}
+
+func TestPostTooLargeUpload(t *testing.T) {
+	mux := setup()
+	oldMaxSize := Config.maxSize
+	Config.maxSize = 2
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".txt"
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fw.Write([]byte("test content"))
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Referer", Config.siteURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 400 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+
+	Config.maxSize = oldMaxSize
+}
+
+func TestPostCollectionSizeLimit(t *testing.T) {
+	mux := setup()
+	oldMaxSize := Config.maxSize
+	Config.maxSize = 8
+	defer func() { Config.maxSize = oldMaxSize }()
+
+	post := func(contents ...string) int {
+		w := httptest.NewRecorder()
+
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		for _, content := range contents {
+			fw, err := mw.CreateFormFile("file", generateBarename()+".txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte(content))
+		}
+		mw.Close()
+
+		req, err := http.NewRequest("POST", "/upload/", &b)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Referer", Config.siteURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// the limit applies to each file, not to all of them
+	if code := post("content", "content", "content"); code != 303 {
+		t.Fatalf("Status code is not 303, but %d", code)
+	}
+	if code := post("content", "too much content"); code != 400 {
+		t.Fatalf("Status code is not 400, but %d", code)
+	}
+}
+
+func TestPostEmptyJSONUpload(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".txt"
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fw.Write([]byte(""))
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 400 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+
+	var myjson RespErrJSON
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if myjson.Error != "Empty file" {
+		t.Fatal("Json 'error' was not 'Empty file' but " + myjson.Error)
+	}
+}
+
+func TestPutUpload(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".file"
+
+	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux.ServeHTTP(w, req)
+
+	if w.Body.String() != fmt.Sprintf("%s\n", Config.siteURL+filename) {
+		t.Fatal("Response was not expected URL")
+	}
+}
+
+func TestPutRandomizedUpload(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".file"
+
+	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Linx-Randomize", "yes")
+
+	mux.ServeHTTP(w, req)
+
+	if w.Body.String() == Config.siteURL+filename {
+		t.Fatal("Filename was not random")
+	}
+}
+
+func TestPutForceRandomUpload(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	oldFRF := Config.forceRandomFilename
+	Config.forceRandomFilename = true
+	filename := "randomizeme.file"
+
+	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// while this should also work without this header, let's try to force
+	// the randomized filename off to be sure
+	req.Header.Set("Linx-Randomize", "no")
+
+	mux.ServeHTTP(w, req)
+
+	if w.Body.String() == Config.siteURL+filename {
+		t.Fatal("Filename was not random")
+	}
+
+	Config.forceRandomFilename = oldFRF
+}
+
+func TestPutNoExtensionUpload(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename()
+
+	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Linx-Randomize", "yes")
+
+	mux.ServeHTTP(w, req)
+
+	if w.Body.String() == Config.siteURL+filename {
+		t.Fatal("Filename was not random")
+	}
+}
+
+func TestPutEmptyUpload(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".file"
+
+	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Linx-Randomize", "yes")
+
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 400 {
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+}
+
+func TestPutTooLargeUpload(t *testing.T) {
+	mux := setup()
+	oldMaxSize := Config.maxSize
+	Config.maxSize = 2
+
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".file"
+
+	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File too big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Linx-Randomize", "yes")
+
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 500 {
+		t.Log(w.Body.String())
+		t.Fatalf("Status code is not 500, but %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "request body too large") {
 		t.Fatal("Response did not contain 'request body too large'")
 	}
 
-	Config.maxSize = oldMaxSize
-}
-
-func TestPutJSONUpload(t *testing.T) {
-	var myjson RespOkJSON
+	Config.maxSize = oldMaxSize
+}
+
+func TestPutJSONUpload(t *testing.T) {
+	var myjson RespOkJSON
+
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".file"
+
+	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	mux.ServeHTTP(w, req)
+
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if myjson.Filename != filename {
+		t.Fatal("Filename was not provided one but " + myjson.Filename)
+	}
+}
+
+func TestPutRandomizedJSONUpload(t *testing.T) {
+	var myjson RespOkJSON
+
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".file"
+
+	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Linx-Randomize", "yes")
+
+	mux.ServeHTTP(w, req)
+
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if myjson.Filename == filename {
+		t.Fatal("Filename was not random ")
+	}
+}
+
+func TestPutExpireJSONUpload(t *testing.T) {
+	var myjson RespOkJSON
+
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".file"
+
+	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Linx-Expiry", "600")
+
+	mux.ServeHTTP(w, req)
+
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiry, err := strconv.Atoi(myjson.Expiry)
+	if err != nil {
+		t.Fatal("Expiry was not an integer")
+	}
+	if expiry < 1 {
+		t.Fatal("Expiry was not set")
+	}
+}
+
+func TestPutAndDelete(t *testing.T) {
+	var myjson RespOkJSON
+
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("PUT", "/upload", strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	mux.ServeHTTP(w, req)
+
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete it
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("DELETE", "/"+myjson.Filename, nil)
+	req.Header.Set("Linx-Delete-Key", myjson.Delete_Key)
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatal("Status code was not 200, but " + strconv.Itoa(w.Code))
+	}
+
+	// Make sure it's actually gone
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+myjson.Filename, nil)
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Fatal("Status code was not 404, but " + strconv.Itoa(w.Code))
+	}
+
+	// Make sure torrent is also gone
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+myjson.Filename+"/torrent", nil)
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Fatal("Status code was not 404, but " + strconv.Itoa(w.Code))
+	}
+}
+
+func TestPutMaxDownloads(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("PUT", "/upload", strings.NewReader("secret"))
+	req.Header.Set("Linx-Max-Downloads", "2")
+	req.Header.Set("Accept", "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	var myjson RespOkJSON
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// the display page doesn't count
+	for i := 0; i < 3; i++ {
+		if code := get("/" + myjson.Filename); code != 200 {
+			t.Fatalf("Display page status code is not 200, but %d", code)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := get("/" + Config.selifPath + myjson.Filename); code != 200 {
+			t.Fatalf("Download %d status code is not 200, but %d", i+1, code)
+		}
+	}
+	if code := get("/" + Config.selifPath + myjson.Filename); code != 404 {
+		t.Fatalf("Status code after the last download is not 404, but %d", code)
+	}
+	if _, err := storageBackend.Head(myjson.Filename); err != backends.NotFoundErr {
+		t.Fatalf("File was not deleted after the last download: %v", err)
+	}
+
+	// concurrent downloads don't go over the limit
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("PUT", "/upload", strings.NewReader("secret"))
+	req.Header.Set("Linx-Max-Downloads", "1")
+	req.Header.Set("Accept", "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes := make(chan int)
+	for i := 0; i < 10; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/"+Config.selifPath+myjson.Filename, nil)
+			fileServeHandler(web.C{URLParams: map[string]string{"name": myjson.Filename}}, w, req)
+			codes <- w.Code
+		}()
+	}
+	served := 0
+	for i := 0; i < 10; i++ {
+		if <-codes == 200 {
+			served++
+		}
+	}
+	if served != 1 {
+		t.Fatalf("File was downloaded %d times instead of once", served)
+	}
+}
+
+func TestMaxDownloadsConditionalAndRange(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("PUT", "/upload", strings.NewReader("secret content"))
+	req.Header.Set("Linx-Max-Downloads", "2")
+	req.Header.Set("Accept", "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	var myjson RespOkJSON
+	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/"+Config.selifPath+myjson.Filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	downloads := func() int64 {
+		metadata, err := storageBackend.Head(myjson.Filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metadata.Downloads
+	}
+
+	w = get("", "")
+	if w.Code != 200 || downloads() != 1 {
+		t.Fatalf("Download was not counted: %d, %d downloads", w.Code, downloads())
+	}
+
+	// revalidating doesn't count, but fetching any range of the file does
+	if w = get("If-None-Match", w.Header().Get("Etag")); w.Code != 304 {
+		t.Fatalf("Status code is not 304, but %d", w.Code)
+	}
+	if w = get("Range", "bytes=6-"); w.Code != 206 || w.Body.String() != " content" {
+		t.Fatalf("Range was not served: %d %q", w.Code, w.Body.String())
+	}
+	if _, err := storageBackend.Head(myjson.Filename); err != backends.NotFoundErr {
+		t.Fatalf("File was not deleted after the last download: %v", err)
+	}
+
+	if w = get("Range", "bytes=0-5"); w.Code != 404 {
+		t.Fatalf("Status code is not 404, but %d", w.Code)
+	}
+}
+
+func TestSlidingExpiry(t *testing.T) {
+	mux := setup()
+	Config.slidingExpiry = 3600
+	defer func() {
+		Config.slidingExpiry = 0
+		Config.maxExpiry = 0
+	}()
+
+	put := func(expiry string) string {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/upload", strings.NewReader("File content"))
+		req.Header.Set("Linx-Expiry", expiry)
+		req.Header.Set("Accept", "application/json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(w, req)
+
+		var myjson RespOkJSON
+		err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return myjson.Filename
+	}
+
+	display := func(filename string) time.Time {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/"+filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("Status code is not 200, but %d", w.Code)
+		}
 
-	mux := setup()
-	w := httptest.NewRecorder()
+		metadata, err := storageBackend.Head(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metadata.Expiry
+	}
 
-	filename := generateBarename() + ".file"
+	setExpiry := func(filename string, expiry time.Time) {
+		metadata, err := storageBackend.Head(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata.Expiry = expiry
+		if err = storageBackend.PutMetadata(filename, metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
-	if err != nil {
-		t.Fatal(err)
+	// files never outlive the expiry they were uploaded with
+	filename := put("60")
+	if kept := display(filename); kept.After(time.Now().Add(60 * time.Second)) {
+		t.Fatalf("Expiry was extended past the one asked for, to %v", kept)
 	}
 
-	req.Header.Set("Accept", "application/json")
+	// and expire once they are idle for the sliding window before that
+	filename = put("7200")
+	if idle := display(filename); idle.After(time.Now().Add(3600*time.Second)) || idle.Before(time.Now().Add(3590*time.Second)) {
+		t.Fatalf("Expiry was not set to the sliding window, got %v", idle)
+	}
 
-	mux.ServeHTTP(w, req)
+	setExpiry(filename, time.Now().Add(60*time.Second))
+	extended := display(filename)
+	if extended.Before(time.Now().Add(3590 * time.Second)) {
+		t.Fatalf("Expiry was not extended, got %v", extended)
+	}
+	if again := display(filename); !again.Equal(extended) {
+		t.Fatalf("Expiry was rewritten right after being extended, from %v to %v", extended, again)
+	}
 
-	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	// up to their deadline
+	metadata, err := storageBackend.Head(filename)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if myjson.Filename != filename {
-		t.Fatal("Filename was not provided one but " + myjson.Filename)
+	metadata.Expiry = time.Now().Add(60 * time.Second)
+	metadata.Deadline = time.Now().Add(120 * time.Second)
+	if err = storageBackend.PutMetadata(filename, metadata); err != nil {
+		t.Fatal(err)
+	}
+	if capped := display(filename); capped.Unix() != metadata.Deadline.Unix() {
+		t.Fatalf("Expiry was not extended to the deadline %v, got %v", metadata.Deadline, capped)
 	}
-}
-
-func TestPutRandomizedJSONUpload(t *testing.T) {
-	var myjson RespOkJSON
 
-	mux := setup()
+	// range requests don't slide the expiry
+	setExpiry(filename, time.Now().Add(60*time.Second))
 	w := httptest.NewRecorder()
-
-	filename := generateBarename() + ".file"
-
-	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	req, err := http.NewRequest("GET", "/"+Config.selifPath+filename, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Linx-Randomize", "yes")
-
+	req.Header.Set("Range", "bytes=4-")
 	mux.ServeHTTP(w, req)
-
-	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
-	if err != nil {
-		t.Fatal(err)
+	if w.Code != 206 {
+		t.Fatalf("Status code is not 206, but %d", w.Code)
+	}
+	if metadata, _ = storageBackend.Head(filename); metadata.Expiry.After(time.Now().Add(60 * time.Second)) {
+		t.Fatalf("Expiry was extended by a range request, to %v", metadata.Expiry)
 	}
 
-	if myjson.Filename == filename {
-		t.Fatal("Filename was not random ")
+	filename = put("0")
+	if never := display(filename); !never.Equal(expiry.NeverExpire) {
+		t.Fatalf("Expiry of a file that never expires was changed to %v", never)
 	}
 }
 
-func TestPutExpireJSONUpload(t *testing.T) {
-	var myjson RespOkJSON
-
-	mux := setup()
-	w := httptest.NewRecorder()
-
-	filename := generateBarename() + ".file"
+func TestParseExpiry(t *testing.T) {
+	Config.maxExpiry = 0
+	defer func() { Config.maxExpiry = 0 }()
+
+	valid := map[string]time.Duration{
+		"":       0,
+		"0":      0,
+		"600":    600 * time.Second,
+		"90m":    90 * time.Minute,
+		"2d":     48 * time.Hour,
+		"1w":     7 * 24 * time.Hour,
+		"1h30m":  90 * time.Minute,
+		"1d1s":   24*time.Hour + time.Second,
+		"99999w": 0, // too long to be represented
+	}
+	for expStr, want := range valid {
+		got, err := parseExpiry(expStr)
+		if err != nil {
+			t.Fatalf("Expiry %q was rejected: %v", expStr, err)
+		}
+		if got != want {
+			t.Fatalf("Expiry %q was %v instead of %v", expStr, got, want)
+		}
+	}
 
-	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	got, err := parseExpiry(future)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if got < 59*time.Minute || got > time.Hour+time.Second {
+		t.Fatalf("Expiry %q was %v instead of an hour", future, got)
+	}
 
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Linx-Expiry", "600")
-
-	mux.ServeHTTP(w, req)
-
-	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
-	if err != nil {
-		t.Fatal(err)
+	invalid := []string{
+		"tomorrow",
+		"-150",
+		"2d ",
+		"1.5h",
+		"3y",
+		"d",
+		time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+	}
+	for _, expStr := range invalid {
+		if _, err := parseExpiry(expStr); err != errInvalidExpiry {
+			t.Fatalf("Expiry %q was not rejected", expStr)
+		}
 	}
 
-	expiry, err := strconv.Atoi(myjson.Expiry)
-	if err != nil {
-		t.Fatal("Expiry was not an integer")
+	Config.maxExpiry = 3600
+	for _, expStr := range []string{"2d", "0", "99999999999999999w"} {
+		got, err := parseExpiry(expStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != time.Hour {
+			t.Fatalf("Expiry %q was %v instead of the maximum expiry", expStr, got)
+		}
 	}
-	if expiry < 1 {
-		t.Fatal("Expiry was not set")
+	if got, _ := parseExpiry("90s"); got != 90*time.Second {
+		t.Fatalf("Expiry below the maximum expiry was %v instead of 90s", got)
 	}
 }
 
-func TestPutAndDelete(t *testing.T) {
-	var myjson RespOkJSON
-
+func TestInvalidExpiryUpload(t *testing.T) {
 	mux := setup()
-	w := httptest.NewRecorder()
 
+	w := httptest.NewRecorder()
 	req, err := http.NewRequest("PUT", "/upload", strings.NewReader("File content"))
 	if err != nil {
 		t.Fatal(err)
 	}
-
+	req.Header.Set("Linx-Expiry", "next week")
 	req.Header.Set("Accept", "application/json")
-
 	mux.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "Invalid expiry") {
+		t.Fatalf("Error was not explained: %s", w.Body.String())
+	}
 
-	err = json.Unmarshal([]byte(w.Body.String()), &myjson)
+	w = httptest.NewRecorder()
+	form := url.Values{}
+	form.Add("content", "File content")
+	form.Add("expires", "2000-01-01T00:00:00Z")
+	req, err = http.NewRequest("POST", "/upload", strings.NewReader(form.Encode()))
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Delete it
-	w = httptest.NewRecorder()
-	req, err = http.NewRequest("DELETE", "/"+myjson.Filename, nil)
-	req.Header.Set("Linx-Delete-Key", myjson.Delete_Key)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", Config.siteURL)
+	req.Header.Set("Accept", "application/json")
 	mux.ServeHTTP(w, req)
-
-	if w.Code != 200 {
-		t.Fatal("Status code was not 200, but " + strconv.Itoa(w.Code))
+	if w.Code != 400 {
+		t.Fatalf("Status code is not 400, but %d", w.Code)
 	}
 
-	// Make sure it's actually gone
 	w = httptest.NewRecorder()
-	req, err = http.NewRequest("GET", "/"+myjson.Filename, nil)
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	mw.WriteField("expires", "soon")
+	fw, err := mw.CreateFormFile("file", generateBarename()+".txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("File content"))
+	mw.Close()
+	req, err = http.NewRequest("POST", "/upload/", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Referer", Config.siteURL)
+	req.Header.Set("Accept", "application/json")
 	mux.ServeHTTP(w, req)
-
-	if w.Code != 404 {
-		t.Fatal("Status code was not 404, but " + strconv.Itoa(w.Code))
+	if w.Code != 400 {
+		t.Fatalf("Status code is not 400, but %d", w.Code)
 	}
 
-	// Make sure torrent is also gone
 	w = httptest.NewRecorder()
-	req, err = http.NewRequest("GET", "/"+myjson.Filename+"/torrent", nil)
+	req, err = http.NewRequest("PUT", "/upload", strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Linx-Expiry", "2d")
+	req.Header.Set("Accept", "application/json")
 	mux.ServeHTTP(w, req)
-
-	if w.Code != 404 {
-		t.Fatal("Status code was not 404, but " + strconv.Itoa(w.Code))
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
 	}
 }
 
@@ -1252,9 +2202,235 @@ func TestInferSiteURLHTTPSFastCGI(t *testing.T) {
 	Config.siteURL = oldSiteURL
 }
 
-func TestShutdown(t *testing.T) {
-	os.RemoveAll(Config.filesDir)
-	os.RemoveAll(Config.metaDir)
+type presignedBackend struct {
+	backends.StorageBackend
+}
+
+func (b presignedBackend) PresignURL(key, mimetype string, expiry time.Duration) (string, error) {
+	return "https://bucket.example.org/" + key + "?expiry=" + strconv.Itoa(int(expiry.Seconds())), nil
+}
+
+func TestPresignedRedirect(t *testing.T) {
+	mux := setup()
+	storageBackend = presignedBackend{storageBackend}
+	Config.s3Presign = true
+	Config.s3PresignExpiry = 60
+	defer func() {
+		Config.s3Presign = false
+	}()
+
+	for _, f := range []struct {
+		name, content string
+	}{
+		{"presigned.txt", "File content"},
+		{"presigned.html", "<script>alert(1)</script>"},
+	} {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/upload/"+f.name, strings.NewReader(f.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Linx-Randomize", "no")
+		mux.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("Upload of %s failed with %d", f.name, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/"+Config.selifPath+"presigned.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 302 {
+		t.Fatalf("Expected 302, got %d", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "https://bucket.example.org/presigned.txt?expiry=60" {
+		t.Fatalf("Redirected to %s", loc)
+	}
+
+	// HEAD requests are answered by linx-server itself
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("HEAD", "/"+Config.selifPath+"presigned.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 for HEAD, got %d", w.Code)
+	}
+
+	// active content is proxied so that it gets our security headers
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+Config.selifPath+"presigned.html", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 for html, got %d", w.Code)
+	}
+	if w.Body.String() != "<script>alert(1)</script>" {
+		t.Fatal("html file was not proxied")
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linx-tus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Config.tusDir = dir
+	defer func() {
+		Config.tusDir = ""
+	}()
+	mux := setup()
+
+	tusRequest := func(method, url string, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := tusRequest("POST", "/tus/", "", map[string]string{
+		"Upload-Length":   "12",
+		"Upload-Metadata": "filename dHVzLnR4dA==",
+		"Linx-Delete-Key": "supersecret",
+		"Linx-Randomize":  "no",
+	})
+	if w.Code != 201 {
+		t.Fatalf("Creation returned %d", w.Code)
+	}
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if !strings.HasPrefix(location.Path, "/tus/") {
+		t.Fatalf("Upload created at %s", location)
+	}
+
+	patch := func(offset, body string) *httptest.ResponseRecorder {
+		return tusRequest("PATCH", location.Path, body, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": offset,
+		})
+	}
+
+	if w = patch("0", "File "); w.Code != 204 || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("First PATCH returned %d at offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w = patch("0", "File "); w.Code != 409 {
+		t.Fatalf("PATCH at the wrong offset returned %d", w.Code)
+	}
+
+	w = tusRequest("HEAD", location.Path, "", nil)
+	if w.Code != 200 || w.Header().Get("Upload-Offset") != "5" || w.Header().Get("Upload-Length") != "12" {
+		t.Fatalf("HEAD returned %d with offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	w = patch("5", "content")
+	if w.Code != 204 {
+		t.Fatalf("Last PATCH returned %d", w.Code)
+	}
+	if w.Header().Get("Linx-Filename") != "tus.txt" || w.Header().Get("Linx-Delete-Key") != "supersecret" {
+		t.Fatalf("Upload was stored as %s", w.Header().Get("Linx-Filename"))
+	}
+
+	m, err := storageBackend.Head("tus.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != 12 || m.DeleteKey != "supersecret" {
+		t.Fatalf("Stored metadata %+v", m)
+	}
+
+	if w = tusRequest("HEAD", location.Path, "", nil); w.Code != 404 {
+		t.Fatalf("Finished upload is still pending, HEAD returned %d", w.Code)
+	}
+
+	// absolute expiries are kept as given, however long uploading takes
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	w = tusRequest("POST", "/tus/", "", map[string]string{
+		"Upload-Length": "12",
+		"Linx-Expiry":   expires.UTC().Format(time.RFC3339),
+	})
+	location, _ = url.Parse(w.Header().Get("Location"))
+	upload, _, _, err := tusRead(strings.TrimPrefix(location.Path, "/tus/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.Expiry.Unix() != expires.Unix() {
+		t.Fatalf("Upload expiry is %v instead of %v", upload.Expiry, expires)
+	}
+	if w = patch("0", "File content"); w.Header().Get("Linx-Expiry") != strconv.FormatInt(expires.Unix(), 10) {
+		t.Fatalf("File expiry is %s instead of %d", w.Header().Get("Linx-Expiry"), expires.Unix())
+	}
+
+	if w = tusRequest("POST", "/tus/", "", map[string]string{"Upload-Length": "12", "Linx-Expiry": "-150"}); w.Code != 400 {
+		t.Fatalf("Creating an upload with an invalid expiry returned %d", w.Code)
+	}
+
+	// termination
+	w = tusRequest("POST", "/tus/", "", map[string]string{"Upload-Length": "12"})
+	location, _ = url.Parse(w.Header().Get("Location"))
+	if w = tusRequest("DELETE", location.Path, "", nil); w.Code != 204 {
+		t.Fatalf("DELETE returned %d", w.Code)
+	}
+	if w = tusRequest("HEAD", location.Path, "", nil); w.Code != 404 {
+		t.Fatalf("Terminated upload is still pending, HEAD returned %d", w.Code)
+	}
+
+	// uploads that are too large are refused upfront
+	w = tusRequest("POST", "/tus/", "", map[string]string{
+		"Upload-Length": strconv.FormatInt(Config.maxSize+1, 10),
+	})
+	if w.Code != 413 {
+		t.Fatalf("Creating a too large upload returned %d", w.Code)
+	}
+
+	req, _ := http.NewRequest("POST", "/tus/", nil)
+	req.Header.Set("Upload-Length", "12")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != 412 {
+		t.Fatalf("Request without Tus-Resumable returned %d", w.Code)
+	}
+
+	// expiration of stale partial uploads
+	Config.tusExpiryMinutes = 60
+	defer func() {
+		Config.tusExpiryMinutes = 0
+	}()
+	w = tusRequest("POST", "/tus/", "", map[string]string{"Upload-Length": "12"})
+	if w.Header().Get("Upload-Expires") == "" {
+		t.Fatal("Upload-Expires was not set")
+	}
+	location, _ = url.Parse(w.Header().Get("Location"))
+	id := strings.TrimPrefix(location.Path, "/tus/")
+
+	stale := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{id, id + ".json"} {
+		os.Chtimes(dir+"/"+name, stale, stale)
+	}
+	if w = tusRequest("HEAD", location.Path, "", nil); w.Code != 404 {
+		t.Fatalf("Expired upload is still pending, HEAD returned %d", w.Code)
+	}
+
+	tusCleanup()
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 0 {
+		t.Fatalf("%d partial upload files were left after cleanup", len(infos))
+	}
 }
 
 func TestPutAndGetCLI(t *testing.T) {
@@ -0,0 +1,6 @@
+// @license magnet:?xt=urn:btih:1f739d935676111cfff4b4693e3816e664797050&dn=gpl-3.0.txt GPL-v3-or-Later
+
+hljs.tabReplace = '    ';
+hljs.initHighlightingOnLoad();
+
+// @license-end
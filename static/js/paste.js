@@ -1,3 +1,44 @@
 // @license magnet:?xt=urn:btih:1f739d935676111cfff4b4693e3816e664797050&dn=gpl-3.0.txt GPL-v3-or-Later
 document.getElementById('content').addEventListener('keydown', handleTab);
+
+// Additional files of the paste, sent as more filename, extension and
+// content fields
+var addFile = document.getElementById('addfile');
+addFile.style.display = "inline-block";
+addFile.addEventListener('click', function (ev) {
+    var file = document.createElement("div");
+
+    var info = document.createElement("div");
+    info.className = "info-flex paste-file";
+    var names = document.createElement("div");
+    if (document.getElementById("filename") != null) {
+        var filename = document.createElement("input");
+        filename.className = "codebox";
+        filename.name = "filename";
+        filename.type = "text";
+        filename.placeholder = "filename";
+        names.appendChild(filename);
+    }
+    names.appendChild(document.createTextNode("."));
+    var extension = document.createElement("input");
+    extension.className = "codebox extension";
+    extension.name = "extension";
+    extension.type = "text";
+    extension.placeholder = "txt";
+    names.appendChild(extension);
+    info.appendChild(names);
+    file.appendChild(info);
+
+    var content = document.createElement("div");
+    content.className = "padme";
+    var textarea = document.createElement("textarea");
+    textarea.name = "content";
+    textarea.className = "editor";
+    textarea.addEventListener('keydown', handleTab);
+    content.appendChild(textarea);
+    file.appendChild(content);
+
+    document.getElementById("morefiles").appendChild(file);
+    textarea.focus();
+});
 // @license-end
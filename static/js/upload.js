@@ -58,7 +58,11 @@ Dropzone.options.dropzone = {
         file.progressElement.innerHTML = p + "%";
         file.uploadElement.setAttribute("style", 'background-image: -webkit-linear-gradient(left, #F2F4F7 ' + p + '%, #E2E2E2 ' + p + '%); background-image: -moz-linear-gradient(left, #F2F4F7 ' + p + '%, #E2E2E2 ' + p + '%); background-image: -ms-linear-gradient(left, #F2F4F7 ' + p + '%, #E2E2E2 ' + p + '%); background-image: -o-linear-gradient(left, #F2F4F7 ' + p + '%, #E2E2E2 ' + p + '%); background-image: linear-gradient(left, #F2F4F7 ' + p + '%, #E2E2E2 ' + p + '%)');
     },
-    sending: function (file, xhr, formData) {
+    sendingmultiple: function (files, xhr, formData) {
+        for (var i = 0; i < files.length; i++) {
+            files[i].collectionIndex = i;
+        }
+
         var randomize = document.getElementById("randomize");
         if (randomize != null) {
             formData.append("randomize", randomize.checked);
@@ -66,6 +70,9 @@ Dropzone.options.dropzone = {
         formData.append("expires", document.getElementById("expires").value);
     },
     success: function (file, resp) {
+        if (resp.files) {
+            resp = resp.files[file.collectionIndex];
+        }
         file.fileActions.removeChild(file.progressElement);
 
         var fileLabelLink = document.createElement("a");
@@ -97,6 +104,47 @@ Dropzone.options.dropzone = {
         file.cancelActionElement = deleteAction;
         file.fileActions.appendChild(deleteAction);
     },
+    successmultiple: function (files, resp) {
+        if (!resp.files) {
+            return;
+        }
+
+        var upload = document.createElement("div");
+        upload.className = "upload";
+
+        var label = document.createElement("span");
+        label.appendChild(document.createTextNode("Collection: "));
+        var link = document.createElement("a");
+        link.href = resp.url;
+        link.target = "_blank";
+        link.innerHTML = resp.url;
+        label.appendChild(link);
+        upload.appendChild(label);
+
+        var actions = document.createElement("div");
+        actions.className = "right";
+        var deleteAction = document.createElement("span");
+        deleteAction.innerHTML = "Delete";
+        deleteAction.className = "cancel";
+        deleteAction.addEventListener('click', function (ev) {
+            var xhr = new XMLHttpRequest();
+            xhr.open("DELETE", resp.url, true);
+            xhr.setRequestHeader("Linx-Delete-Key", resp.delete_key);
+            xhr.onreadystatechange = function () {
+                if (xhr.readyState == 4 && xhr.status === 200) {
+                    label.insertBefore(document.createTextNode("Deleted "), label.firstChild);
+                    label.className = "deleted";
+                    actions.removeChild(deleteAction);
+                }
+            };
+            xhr.send();
+        });
+        actions.appendChild(deleteAction);
+        upload.appendChild(actions);
+
+        var uploads = document.getElementById("uploads");
+        uploads.insertBefore(upload, files[0].uploadElement);
+    },
     canceled: function (file) {
         this.options.error(file);
     },
@@ -124,7 +172,9 @@ Dropzone.options.dropzone = {
     autoProcessQueue: document.getElementById("dropzone").getAttribute("data-auth") !== "basic",
     maxFilesize: Math.round(parseInt(document.getElementById("dropzone").getAttribute("data-maxsize"), 10) / 1024 / 1024),
     previewsContainer: "#uploads",
-    parallelUploads: 5,
+    uploadMultiple: true,
+    paramName: function () { return "file"; },
+    parallelUploads: 100,
     headers: { "Accept": "application/json" },
     dictDefaultMessage: "Click or Drop file(s) or Paste image",
     dictFallbackMessage: ""
@@ -62,6 +62,7 @@ func populateTemplatesMap(tSet *pongo2.TemplateSet, tMap map[string]*pongo2.Temp
 		"display/story.html",
 		"display/md.html",
 		"display/file.html",
+		"display/collection.html",
 	}
 
 	for _, tName := range templates {
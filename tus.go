@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/dchest/uniuri"
+	"github.com/zenazn/goji/web"
+)
+
+// Resumable uploads, following the tus protocol (https://tus.io/). Partial
+// uploads are kept in Config.tusDir as a data file named after the upload
+// id, along with a JSON file describing the upload request, until all of
+// their bytes have been received and they go through processUpload.
+
+const tusVersion = "1.0.0"
+
+var tusIDRe = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+// ids of partial uploads being written to or finalized
+var tusBusy = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+type tusUpload struct {
+	Length       int64     `json:"length"`
+	Filename     string    `json:"filename"`
+	Expiry       time.Time `json:"expiry"` // expiry.NeverExpire = never
+	DeleteKey    string    `json:"delete_key"`
+	AccessKey    string    `json:"access_key"`
+	Randomize    bool      `json:"randomize"`
+	MaxDownloads int64     `json:"max_downloads,omitempty"`
+}
+
+func tusPaths(id string) (data, info string) {
+	data = filepath.Join(Config.tusDir, id)
+	return data, data + ".json"
+}
+
+func tusExpiry() time.Duration {
+	return time.Duration(Config.tusExpiryMinutes) * time.Minute
+}
+
+// Partial uploads expire once they haven't been written to for
+// Config.tusExpiryMinutes, unless that is 0
+func tusExpired(modtime time.Time) bool {
+	return Config.tusExpiryMinutes > 0 && time.Since(modtime) > tusExpiry()
+}
+
+func tusSetExpires(w http.ResponseWriter, modtime time.Time) {
+	if Config.tusExpiryMinutes > 0 {
+		w.Header().Set("Upload-Expires", modtime.Add(tusExpiry()).UTC().Format(http.TimeFormat))
+	}
+}
+
+// Read a partial upload, returning its description and how many of its
+// bytes have been received so far
+func tusRead(id string) (upload tusUpload, offset int64, modtime time.Time, err error) {
+	if !tusIDRe.MatchString(id) {
+		return upload, 0, modtime, backends.NotFoundErr
+	}
+	data, info := tusPaths(id)
+
+	stat, err := os.Stat(data)
+	if os.IsNotExist(err) {
+		return upload, 0, modtime, backends.NotFoundErr
+	} else if err != nil {
+		return
+	}
+	if tusExpired(stat.ModTime()) {
+		return upload, 0, modtime, backends.NotFoundErr
+	}
+
+	js, err := ioutil.ReadFile(info)
+	if os.IsNotExist(err) {
+		return upload, 0, modtime, backends.NotFoundErr
+	} else if err != nil {
+		return
+	}
+	if err = json.Unmarshal(js, &upload); err != nil {
+		return upload, 0, modtime, backends.BadMetadata
+	}
+
+	return upload, stat.Size(), stat.ModTime(), nil
+}
+
+func tusRemove(id string) {
+	data, info := tusPaths(id)
+	os.Remove(info)
+	os.Remove(data)
+}
+
+func tusLock(id string) bool {
+	tusBusy.Lock()
+	defer tusBusy.Unlock()
+
+	if tusBusy.ids[id] {
+		return false
+	}
+	tusBusy.ids[id] = true
+	return true
+}
+
+func tusUnlock(id string) {
+	tusBusy.Lock()
+	defer tusBusy.Unlock()
+
+	delete(tusBusy.ids, id)
+}
+
+// Upload-Metadata is a comma-separated list of keys and base64 values
+func tusParseMetadata(header string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 {
+			continue
+		}
+
+		value := ""
+		if len(parts) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		m[parts[0]] = value
+	}
+	return m
+}
+
+func tusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// All requests but OPTIONS must state the protocol version they use
+func tusCheckVersion(w http.ResponseWriter, r *http.Request) bool {
+	tusHeaders(w)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func tusOptionsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	tusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination,expiration")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(Config.maxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusCreateHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !tusCheckVersion(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		badRequestHandler(c, w, r, RespPLAIN, "Invalid Upload-Length")
+		return
+	} else if length == 0 {
+		badRequestHandler(c, w, r, RespPLAIN, backends.FileEmptyError.Error())
+		return
+	} else if length > Config.maxSize {
+		http.Error(w, FileTooLargeError.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	upReq := UploadRequest{}
+	if err := uploadHeaderProcess(r, &upReq); err != nil {
+		badRequestHandler(c, w, r, RespPLAIN, err.Error())
+		return
+	}
+
+	metadata := tusParseMetadata(r.Header.Get("Upload-Metadata"))
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+
+	js, err := json.Marshal(tusUpload{
+		Length:       length,
+		Filename:     filename,
+		Expiry:       expiryTime(upReq.expiry),
+		DeleteKey:    upReq.deleteKey,
+		AccessKey:    upReq.accessKey,
+		Randomize:    upReq.randomBarename,
+		MaxDownloads: upReq.maxDownloads,
+	})
+	if err != nil {
+		oopsHandler(c, w, r, RespPLAIN, "Could not create upload")
+		return
+	}
+
+	id := uniuri.NewLen(32)
+	data, info := tusPaths(id)
+	if err = ioutil.WriteFile(data, nil, 0600); err == nil {
+		err = ioutil.WriteFile(info, js, 0600)
+	}
+	if err != nil {
+		tusRemove(id)
+		oopsHandler(c, w, r, RespPLAIN, "Could not create upload")
+		return
+	}
+
+	w.Header().Set("Location", getSiteURL(r)+"tus/"+id)
+	tusSetExpires(w, time.Now())
+	w.WriteHeader(http.StatusCreated)
+}
+
+func tusHeadHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !tusCheckVersion(w, r) {
+		return
+	}
+
+	upload, offset, modtime, err := tusRead(c.URLParams["id"])
+	if err == backends.NotFoundErr {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	tusSetExpires(w, modtime)
+	w.WriteHeader(http.StatusOK)
+}
+
+func tusPatchHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !tusCheckVersion(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	id := c.URLParams["id"]
+	if !tusLock(id) {
+		http.Error(w, "Upload is already in progress", http.StatusConflict)
+		return
+	}
+	defer tusUnlock(id)
+
+	upload, offset, _, err := tusRead(id)
+	if err == backends.NotFoundErr {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, RespPLAIN, "Could not read upload")
+		return
+	}
+
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	data, _ := tusPaths(id)
+	f, err := os.OpenFile(data, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		oopsHandler(c, w, r, RespPLAIN, "Could not write upload")
+		return
+	}
+
+	// Keep whatever was received if the connection drops, so that the
+	// client can resume from there
+	n, err := io.Copy(f, io.LimitReader(r.Body, upload.Length-offset))
+	offset += n
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		if !Config.noLogs {
+			log.Printf("Upload %s interrupted at %d bytes: %v", id, offset, err)
+		}
+		oopsHandler(c, w, r, RespPLAIN, "Could not write upload")
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	tusSetExpires(w, time.Now())
+	if offset < upload.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// The expiry was fixed when the upload was created, as given times
+	// must not move by how long uploading took
+	var fileExpiry time.Duration
+	if !upload.Expiry.Equal(expiry.NeverExpire) {
+		fileExpiry = time.Until(upload.Expiry)
+		if fileExpiry <= 0 {
+			tusRemove(id)
+			badRequestHandler(c, w, r, RespPLAIN, "Upload expired before it was completed.")
+			return
+		}
+	}
+
+	// Complete, store it as any other upload. On failure the partial upload
+	// is kept, so that the client can try finishing it again.
+	f, err = os.Open(data)
+	if err != nil {
+		oopsHandler(c, w, r, RespPLAIN, "Could not read upload")
+		return
+	}
+	defer f.Close()
+
+	stored, err := processUpload(UploadRequest{
+		src:            f,
+		size:           upload.Length,
+		filename:       upload.Filename,
+		expiry:         fileExpiry,
+		deleteKey:      upload.DeleteKey,
+		accessKey:      upload.AccessKey,
+		randomBarename: upload.Randomize,
+		maxDownloads:   upload.MaxDownloads,
+	})
+	if isBadUploadRequest(err) {
+		badRequestHandler(c, w, r, RespPLAIN, err.Error())
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, RespPLAIN, "Could not upload file: "+err.Error())
+		return
+	}
+	tusRemove(id)
+
+	w.Header().Set("Linx-Url", getSiteURL(r)+stored.Filename)
+	w.Header().Set("Linx-Direct-Url", getSiteURL(r)+Config.selifPath+stored.Filename)
+	w.Header().Set("Linx-Filename", stored.Filename)
+	w.Header().Set("Linx-Delete-Key", stored.Metadata.DeleteKey)
+	w.Header().Set("Linx-Expiry", strconv.FormatInt(stored.Metadata.Expiry.Unix(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !tusCheckVersion(w, r) {
+		return
+	}
+
+	id := c.URLParams["id"]
+	if !tusLock(id) {
+		http.Error(w, "Upload is in progress", http.StatusConflict)
+		return
+	}
+	defer tusUnlock(id)
+
+	if _, _, _, err := tusRead(id); err == backends.NotFoundErr {
+		notFoundHandler(c, w, r)
+		return
+	}
+	tusRemove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Remove expired partial uploads
+func tusCleanup() {
+	infos, err := ioutil.ReadDir(Config.tusDir)
+	if err != nil {
+		log.Printf("Failed to list partial uploads: %v", err)
+		return
+	}
+
+	for _, info := range infos {
+		id := strings.TrimSuffix(info.Name(), ".json")
+		if !tusIDRe.MatchString(id) || !tusExpired(info.ModTime()) {
+			continue
+		}
+
+		// the data file is what is written to
+		if data, _ := tusPaths(id); info.Name() != id {
+			if stat, err := os.Stat(data); err == nil && !tusExpired(stat.ModTime()) {
+				continue
+			}
+		}
+
+		if tusLock(id) {
+			if !Config.noLogs {
+				log.Printf("Delete partial upload %s", id)
+			}
+			tusRemove(id)
+			tusUnlock(id)
+		}
+	}
+}
+
+func tusPeriodicCleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		tusCleanup()
+	}
+}
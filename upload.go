@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
 	"path"
@@ -24,6 +26,17 @@ import (
 )
 
 var FileTooLargeError = errors.New("File too large.")
+
+var errTooManyFiles = errors.New("Too many files.")
+var errInvalidExpiry = errors.New("Invalid expiry, use a number of seconds, a duration such as 90m, 2d or 1w, or an RFC 3339 time in the future.")
+
+// Space allowed for the form fields of multipart uploads, on top of the
+// files themselves
+const maxFormFieldsSize = 1024 * 1024
+
+// Most files a collection can be made of
+const maxCollectionFiles = 100
+
 var fileBlacklist = map[string]bool{
 	"favicon.ico":     true,
 	"index.htm":       true,
@@ -42,6 +55,16 @@ type UploadRequest struct {
 	deleteKey      string        // Empty string if not defined
 	randomBarename bool
 	accessKey      string // Empty string if not defined
+	maxDownloads   int64  // 0 = no limit
+	mimetype       string // Detected from the contents if empty
+
+	// Used instead of expiry if set, to keep that of other files
+	expires  time.Time
+	deadline time.Time
+
+	// Files stored along with this one, which it must not overwrite even
+	// though they share its delete key
+	siblings map[string]bool
 }
 
 // Metadata associated with a file as it would actually be stored
@@ -51,55 +74,54 @@ type Upload struct {
 }
 
 func uploadPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-	if !strictReferrerCheck(r, getSiteURL(r), []string{"Linx-Delete-Key", "Linx-Expiry", "Linx-Randomize", "X-Requested-With"}) {
+	if !strictReferrerCheck(r, getSiteURL(r), []string{"Linx-Delete-Key", "Linx-Expiry", "Linx-Randomize", "Linx-Max-Downloads", "X-Requested-With"}) {
 		badRequestHandler(c, w, r, RespAUTO, "")
 		return
 	}
 
 	upReq := UploadRequest{}
-	uploadHeaderProcess(r, &upReq)
+	if err := uploadHeaderProcess(r, &upReq); err != nil {
+		badRequestHandler(c, w, r, RespAUTO, err.Error())
+		return
+	}
 
 	contentType := r.Header.Get("Content-Type")
 
+	var upload Upload
+	var files []Upload
+	var err error
 	if strings.HasPrefix(contentType, "multipart/form-data") {
-		file, headers, err := r.FormFile("file")
-		if err != nil {
-			oopsHandler(c, w, r, RespHTML, "Could not upload file.")
-			return
-		}
-		defer file.Close()
-
-		upReq.src = file
-		upReq.size = headers.Size
-		upReq.filename = headers.Filename
+		// form fields override the headers, as for pastes
+		r.Body = http.MaxBytesReader(w, r.Body, maxMultipartSize())
+		upload, files, err = processMultipartUpload(r, upReq)
 	} else {
 		if r.PostFormValue("content") == "" {
 			badRequestHandler(c, w, r, RespAUTO, "Empty file")
 			return
 		}
-		extension := r.PostFormValue("extension")
-		if extension == "" {
-			extension = "txt"
-		}
-
-		content := r.PostFormValue("content")
 
-		upReq.src = strings.NewReader(content)
-		upReq.size = int64(len(content))
-		upReq.filename = r.PostFormValue("filename") + "." + extension
-	}
+		// form fields override the headers
+		if _, ok := r.PostForm[accessKeyParamName]; ok {
+			upReq.accessKey = r.PostFormValue(accessKeyParamName)
+		}
+		if _, ok := r.PostForm["max_downloads"]; ok {
+			upReq.maxDownloads = parseMaxDownloads(r.PostFormValue("max_downloads"))
+		}
 
-	upReq.expiry = parseExpiry(r.PostFormValue("expires"))
-	upReq.accessKey = r.PostFormValue(accessKeyParamName)
+		if r.PostFormValue("randomize") == "true" {
+			upReq.randomBarename = true
+		}
 
-	if r.PostFormValue("randomize") == "true" {
-		upReq.randomBarename = true
+		if _, ok := r.PostForm["expires"]; ok {
+			upReq.expiry, err = parseExpiry(r.PostFormValue("expires"))
+		}
+		if err == nil {
+			upload, files, err = processPaste(r.PostForm, upReq)
+		}
 	}
 
-	upload, err := processUpload(upReq)
-
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		if err == FileTooLargeError || err == backends.FileEmptyError {
+		if isBadUploadRequest(err) {
 			badRequestHandler(c, w, r, RespJSON, err.Error())
 			return
 		} else if err != nil {
@@ -107,11 +129,16 @@ func uploadPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		js := generateJSONresponse(upload, r)
+		var js []byte
+		if files != nil {
+			js = generateCollectionJSONresponse(upload, files, r)
+		} else {
+			js = generateJSONresponse(upload, r)
+		}
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.Write(js)
 	} else {
-		if err == FileTooLargeError || err == backends.FileEmptyError {
+		if isBadUploadRequest(err) {
 			badRequestHandler(c, w, r, RespHTML, err.Error())
 			return
 		} else if err != nil {
@@ -123,18 +150,261 @@ func uploadPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Stream the files of a multipart/form-data upload to the storage backend
+// as they are received. Form fields sent before a file apply to it as they
+// do for other uploads. Fields sent after it can only be applied once it
+// is stored, by updating its metadata or, to randomize its name, storing
+// it again. Several files are grouped in a collection, which is what is
+// returned along with them.
+func processMultipartUpload(r *http.Request, upReq UploadRequest) (upload Upload, files []Upload, err error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return
+	}
+
+	if upReq.deleteKey == "" {
+		upReq.deleteKey = uniuri.NewLen(30)
+	}
+	randomized := upReq.randomBarename
+
+	defer func() {
+		if err != nil {
+			for _, f := range files {
+				storageBackend.Delete(f.Filename)
+			}
+		}
+	}()
+
+	var names []string
+	upReq.siblings = make(map[string]bool)
+	late := false
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return upload, files, err
+		}
+
+		if part.FormName() == "file" {
+			if len(files) == maxCollectionFiles {
+				return upload, files, errTooManyFiles
+			}
+
+			src := &limitedReader{r: part, n: Config.maxSize}
+			upReq.src = src
+			upReq.filename = part.FileName()
+			f, err := processUpload(upReq)
+			if src.exceeded {
+				err = FileTooLargeError
+			}
+			if err != nil {
+				return upload, files, err
+			}
+
+			files = append(files, f)
+			names = append(names, part.FileName())
+			upReq.siblings[f.Filename] = true
+			continue
+		}
+
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxFormFieldsSize))
+		if err != nil {
+			return upload, files, err
+		}
+		switch part.FormName() {
+		case "expires":
+			upReq.expiry, err = parseExpiry(string(value))
+			if err != nil {
+				return upload, files, err
+			}
+		case accessKeyParamName:
+			upReq.accessKey = string(value)
+		case "max_downloads":
+			upReq.maxDownloads = parseMaxDownloads(string(value))
+		case "randomize":
+			upReq.randomBarename = upReq.randomBarename || string(value) == "true"
+		default:
+			continue
+		}
+		late = late || len(files) > 0
+	}
+
+	if len(files) == 0 {
+		return upload, files, errors.New("No file was uploaded")
+	}
+
+	if late {
+		for i := range files {
+			files[i], err = applyLateFields(files[i], upReq, randomized)
+			if err != nil {
+				return upload, files, err
+			}
+		}
+	}
+
+	if len(files) == 1 {
+		return files[0], nil, nil
+	}
+
+	upload, err = processCollection(files, names, upReq)
+	return
+}
+
+// Apply the fields of an upload request which were only known once the
+// file was stored
+func applyLateFields(upload Upload, upReq UploadRequest, randomized bool) (Upload, error) {
+	if upReq.randomBarename && !randomized {
+		_, src, err := storageBackend.Get(upload.Filename)
+		if err != nil {
+			return upload, err
+		}
+		defer src.Close()
+
+		upReq.src = src
+		upReq.filename = upload.Filename
+		moved, err := processUpload(upReq)
+		if err != nil {
+			return upload, err
+		}
+
+		storageBackend.Delete(upload.Filename)
+		return moved, nil
+	}
+
+	upload.Metadata.Expiry, upload.Metadata.Deadline = uploadExpiry(upReq.expiry)
+	upload.Metadata.AccessKey = upReq.accessKey
+	upload.Metadata.MaxDownloads = upReq.maxDownloads
+	return upload, storageBackend.PutMetadata(upload.Filename, upload.Metadata)
+}
+
+// Store the files pasted in a form, each given by a content field along
+// with optional filename and extension fields. Several files are grouped
+// in a collection, which is what is returned along with them.
+func processPaste(form url.Values, upReq UploadRequest) (upload Upload, files []Upload, err error) {
+	if upReq.deleteKey == "" {
+		upReq.deleteKey = uniuri.NewLen(30)
+	}
+
+	defer func() {
+		if err != nil {
+			for _, f := range files {
+				storageBackend.Delete(f.Filename)
+			}
+		}
+	}()
+
+	var names []string
+	upReq.siblings = make(map[string]bool)
+	for i, content := range form["content"] {
+		// forms can have extra files left empty
+		if content == "" {
+			continue
+		}
+		if len(files) == maxCollectionFiles {
+			return upload, files, errTooManyFiles
+		}
+
+		filename := formValueAt(form, "filename", i)
+		extension := formValueAt(form, "extension", i)
+		if extension == "" {
+			extension = "txt"
+		}
+
+		upReq.src = strings.NewReader(content)
+		upReq.size = int64(len(content))
+		upReq.filename = filename + "." + extension
+		f, err := processUpload(upReq)
+		if err != nil {
+			return upload, files, err
+		}
+
+		files = append(files, f)
+		upReq.siblings[f.Filename] = true
+		if filename != "" {
+			names = append(names, upReq.filename)
+		} else {
+			names = append(names, f.Filename)
+		}
+	}
+
+	if len(files) == 0 {
+		return upload, files, backends.FileEmptyError
+	} else if len(files) == 1 {
+		return files[0], nil, nil
+	}
+
+	upload, err = processCollection(files, names, upReq)
+	return
+}
+
+// The largest multipart upload allowed, each of its files being limited to
+// the maximum size
+func maxMultipartSize() int64 {
+	if Config.maxSize > (math.MaxInt64-maxFormFieldsSize)/maxCollectionFiles {
+		return math.MaxInt64
+	}
+	return Config.maxSize*maxCollectionFiles + maxFormFieldsSize
+}
+
+// The i-th value of a form field, which is empty if the field was given
+// fewer times
+func formValueAt(form url.Values, key string, i int) string {
+	if i < len(form[key]) {
+		return form[key][i]
+	}
+	return ""
+}
+
+// limitedReader fails with FileTooLargeError as soon as more than n bytes
+// have been read.
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (n int, err error) {
+	if l.exceeded {
+		return 0, FileTooLargeError
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err = l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		l.exceeded = true
+		return 0, FileTooLargeError
+	}
+	return
+}
+
 func uploadPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	upReq := UploadRequest{}
-	uploadHeaderProcess(r, &upReq)
+	if err := uploadHeaderProcess(r, &upReq); err != nil {
+		badRequestHandler(c, w, r, RespAUTO, err.Error())
+		return
+	}
 
 	defer r.Body.Close()
-	upReq.filename = c.URLParams["name"]
-	upReq.src = http.MaxBytesReader(w, r.Body, Config.maxSize)
 
-	upload, err := processUpload(upReq)
+	var upload Upload
+	var files []Upload
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxMultipartSize())
+		upload, files, err = processMultipartUpload(r, upReq)
+	} else {
+		upReq.filename = c.URLParams["name"]
+		upReq.src = http.MaxBytesReader(w, r.Body, Config.maxSize)
+
+		upload, err = processUpload(upReq)
+	}
 
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		if err == FileTooLargeError || err == backends.FileEmptyError {
+		if isBadUploadRequest(err) {
 			badRequestHandler(c, w, r, RespJSON, err.Error())
 			return
 		} else if err != nil {
@@ -142,11 +412,16 @@ func uploadPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		js := generateJSONresponse(upload, r)
+		var js []byte
+		if files != nil {
+			js = generateCollectionJSONresponse(upload, files, r)
+		} else {
+			js = generateJSONresponse(upload, r)
+		}
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.Write(js)
 	} else {
-		if err == FileTooLargeError || err == backends.FileEmptyError {
+		if isBadUploadRequest(err) {
 			badRequestHandler(c, w, r, RespPLAIN, err.Error())
 			return
 		} else if err != nil {
@@ -190,6 +465,12 @@ func uploadRemote(c web.C, w http.ResponseWriter, r *http.Request) {
 	grabUrl, _ := url.Parse(r.FormValue("url"))
 	directURL := r.FormValue("direct_url") == "yes"
 
+	expiry, err := parseExpiry(r.FormValue("expiry"))
+	if err != nil {
+		badRequestHandler(c, w, r, RespAUTO, err.Error())
+		return
+	}
+
 	resp, err := http.Get(grabUrl.String())
 	if err != nil {
 		oopsHandler(c, w, r, RespAUTO, "Could not retrieve URL")
@@ -201,7 +482,7 @@ func uploadRemote(c web.C, w http.ResponseWriter, r *http.Request) {
 	upReq.deleteKey = r.FormValue("deletekey")
 	upReq.accessKey = r.FormValue(accessKeyParamName)
 	upReq.randomBarename = r.FormValue("randomize") == "yes"
-	upReq.expiry = parseExpiry(r.FormValue("expiry"))
+	upReq.expiry = expiry
 
 	upload, err := processUpload(upReq)
 
@@ -228,7 +509,7 @@ func uploadRemote(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func uploadHeaderProcess(r *http.Request, upReq *UploadRequest) {
+func uploadHeaderProcess(r *http.Request, upReq *UploadRequest) (err error) {
 	if r.Header.Get("Linx-Randomize") == "yes" {
 		upReq.randomBarename = true
 	}
@@ -236,9 +517,11 @@ func uploadHeaderProcess(r *http.Request, upReq *UploadRequest) {
 	upReq.deleteKey = r.Header.Get("Linx-Delete-Key")
 	upReq.accessKey = r.Header.Get(accessKeyHeaderName)
 
-	// Get seconds until expiry. Non-integer responses never expire.
 	expStr := r.Header.Get("Linx-Expiry")
-	upReq.expiry = parseExpiry(expStr)
+	upReq.expiry, err = parseExpiry(expStr)
+
+	upReq.maxDownloads = parseMaxDownloads(r.Header.Get("Linx-Max-Downloads"))
+	return
 }
 
 func processUpload(upReq UploadRequest) (upload Upload, err error) {
@@ -281,7 +564,7 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 	fileexists, _ := storageBackend.Exists(upload.Filename)
 
 	// Check if the delete key matches, in which case overwrite
-	if fileexists {
+	if fileexists && !upReq.siblings[upload.Filename] {
 		metad, merr := storageBackend.Head(upload.Filename)
 		if merr == nil {
 			if upReq.deleteKey == metad.DeleteKey {
@@ -323,18 +606,23 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 	}
 
 	// Get the rest of the metadata needed for storage
-	var fileExpiry time.Time
-	if upReq.expiry == 0 {
-		fileExpiry = expiry.NeverExpire
-	} else {
-		fileExpiry = time.Now().Add(upReq.expiry)
+	fileExpiry, deadline := uploadExpiry(upReq.expiry)
+	if !upReq.expires.IsZero() {
+		fileExpiry, deadline = upReq.expires, upReq.deadline
 	}
 
 	if upReq.deleteKey == "" {
 		upReq.deleteKey = uniuri.NewLen(30)
 	}
 
-	upload.Metadata, err = storageBackend.Put(upload.Filename, io.MultiReader(bytes.NewReader(header), upReq.src), fileExpiry, upReq.deleteKey, upReq.accessKey)
+	upload.Metadata, err = storageBackend.Put(upload.Filename, io.MultiReader(bytes.NewReader(header), upReq.src), backends.Metadata{
+		Expiry:       fileExpiry,
+		Deadline:     deadline,
+		DeleteKey:    upReq.deleteKey,
+		AccessKey:    upReq.accessKey,
+		MaxDownloads: upReq.maxDownloads,
+		Mimetype:     upReq.mimetype,
+	})
 	if err != nil {
 		return upload, err
 	}
@@ -342,12 +630,50 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 	return
 }
 
+// Errors caused by what was uploaded rather than by the server
+func isBadUploadRequest(err error) bool {
+	return err == FileTooLargeError || err == backends.FileEmptyError || err == errTooManyFiles || err == errInvalidExpiry
+}
+
+// The time at which a file uploaded now with the given expiry expires
+func expiryTime(d time.Duration) time.Time {
+	if d == 0 {
+		return expiry.NeverExpire
+	}
+	return time.Now().Add(d)
+}
+
 func generateBarename() string {
 	return uniuri.NewLenChars(8, []byte("abcdefghijklmnopqrstuvwxyz0123456789"))
 }
 
 func generateJSONresponse(upload Upload, r *http.Request) []byte {
-	js, _ := json.Marshal(map[string]string{
+	js, _ := json.Marshal(uploadJSON(upload, r))
+
+	return js
+}
+
+// The response to an upload of several files, describing the collection
+// they were grouped in as well as each of them
+func generateCollectionJSONresponse(upload Upload, files []Upload, r *http.Request) []byte {
+	resp := make(map[string]interface{})
+	for k, v := range uploadJSON(upload, r) {
+		resp[k] = v
+	}
+
+	var filesJSON []map[string]string
+	for _, f := range files {
+		filesJSON = append(filesJSON, uploadJSON(f, r))
+	}
+	resp["files"] = filesJSON
+
+	js, _ := json.Marshal(resp)
+
+	return js
+}
+
+func uploadJSON(upload Upload, r *http.Request) map[string]string {
+	resp := map[string]string{
 		"url":        getSiteURL(r) + upload.Filename,
 		"direct_url": getSiteURL(r) + Config.selifPath + upload.Filename,
 		"filename":   upload.Filename,
@@ -357,9 +683,12 @@ func generateJSONresponse(upload Upload, r *http.Request) []byte {
 		"size":       strconv.FormatInt(upload.Metadata.Size, 10),
 		"mimetype":   upload.Metadata.Mimetype,
 		"sha256sum":  upload.Metadata.Sha256sum,
-	})
+	}
+	if upload.Metadata.MaxDownloads > 0 {
+		resp["max_downloads"] = strconv.FormatInt(upload.Metadata.MaxDownloads, 10)
+	}
 
-	return js
+	return resp
 }
 
 var bareRe = regexp.MustCompile(`[^A-Za-z0-9\-]`)
@@ -396,18 +725,58 @@ func barePlusExt(filename string) (barename, extension string) {
 	return
 }
 
-func parseExpiry(expStr string) time.Duration {
+var expiryDurationRe = regexp.MustCompile(`^([0-9]+[smhdw])+$`)
+var expiryUnitRe = regexp.MustCompile(`([0-9]+)([smhdw])`)
+var expiryUnits = map[string]uint64{
+	"s": 1,
+	"m": 60,
+	"h": 60 * 60,
+	"d": 24 * 60 * 60,
+	"w": 7 * 24 * 60 * 60,
+}
+
+// Parse the expiry of an upload, given as seconds, as a duration such as
+// 90m, 2d or 1w12h, or as an RFC 3339 time in the future. It defaults to
+// and is capped by the maximum expiry, 0 meaning no expiry.
+func parseExpiry(expStr string) (time.Duration, error) {
 	if expStr == "" {
-		return time.Duration(Config.maxExpiry) * time.Second
-	} else {
-		fileExpiry, err := strconv.ParseUint(expStr, 10, 64)
-		if err != nil {
-			return time.Duration(Config.maxExpiry) * time.Second
-		} else {
-			if Config.maxExpiry > 0 && (fileExpiry > Config.maxExpiry || fileExpiry == 0) {
-				fileExpiry = Config.maxExpiry
+		return time.Duration(Config.maxExpiry) * time.Second, nil
+	}
+
+	// longest expiry that can be represented, anything longer never expires
+	maxSeconds := uint64(math.MaxInt64 / time.Second)
+
+	fileExpiry, err := strconv.ParseUint(expStr, 10, 64)
+	if err != nil && expiryDurationRe.MatchString(expStr) {
+		fileExpiry = 0
+		for _, m := range expiryUnitRe.FindAllStringSubmatch(expStr, -1) {
+			n, perr := strconv.ParseUint(m[1], 10, 64)
+			if perr != nil || n > (maxSeconds-fileExpiry)/expiryUnits[m[2]] {
+				fileExpiry = maxSeconds + 1
+				break
 			}
-			return time.Duration(fileExpiry) * time.Second
+			fileExpiry += n * expiryUnits[m[2]]
+		}
+	} else if err != nil {
+		t, perr := time.Parse(time.RFC3339, expStr)
+		if perr != nil || !t.After(time.Now()) {
+			return 0, errInvalidExpiry
 		}
+
+		// keep the time as given rather than rounding it to seconds
+		d := time.Until(t)
+		if Config.maxExpiry > 0 && d > time.Duration(Config.maxExpiry)*time.Second {
+			d = time.Duration(Config.maxExpiry) * time.Second
+		}
+		return d, nil
+	}
+
+	if fileExpiry > maxSeconds {
+		fileExpiry = 0
+	}
+
+	if Config.maxExpiry > 0 && (fileExpiry > Config.maxExpiry || fileExpiry == 0) {
+		fileExpiry = Config.maxExpiry
 	}
+	return time.Duration(fileExpiry) * time.Second, nil
 }